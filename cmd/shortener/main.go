@@ -4,21 +4,37 @@ import (
 	"context"
 	"github.com/Taboon/urlshortner/internal/server/auth"
 	"github.com/Taboon/urlshortner/internal/storage"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Taboon/urlshortner/internal/config"
 	"github.com/Taboon/urlshortner/internal/domain/usecase"
 	"github.com/Taboon/urlshortner/internal/logger"
 	"github.com/Taboon/urlshortner/internal/server"
 
-	_ "github.com/jackc/pgx/v5"
 	"go.uber.org/zap"
 )
 
 func main() { //nolint:funlen
+	if len(os.Args) > 1 && os.Args[1] == "migrate-data" {
+		if err := migrateData(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	conf := config.SetConfig()
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	// инициализируем логгер
 	l, err := logger.Initialize(*conf)
 	if err != nil {
@@ -26,31 +42,85 @@ func main() { //nolint:funlen
 	}
 
 	// инициализируем хранилище
-	var stor storage.Repository
-
-	switch {
-	case conf.DataBase != "":
-		db, s := storage.SetPostgres(ctx, conf, l)
-		stor = s
-		defer func(db *pgxpool.Pool) {
-			db.Close()
-		}(db)
-	default:
-		internalStor := storage.NewMemoryStorage(l)
-
-		l.Info("Используем память приложения для хранения")
+	opts, err := storageOptions(conf.FileBase.Key, conf.FileBase.OldKeys)
+	if err != nil {
+		panic(err)
+	}
+	opts.Migrate = storage.MigrateOptions{Manual: !conf.AutoMigrate, LockTimeout: conf.MigrateLockTimeout}
+	stor, err := storage.OpenWith(ctx, conf.StorageDSN(), opts, l)
+	if err != nil {
+		panic(err)
+	}
+	metrics := &server.Metrics{}
+	// изменения от других экземпляров сервиса применяются к фильтру и локальному кешу
+	listener, _ := stor.(storage.ChangeListener)
+	var appliers []func(storage.ChangeEvent)
 
-		// инициализируем бекап и загружаем из него данные
-		if conf.FileBase.File != "" {
-			l.Info("Используем бекап файл", zap.String("file", conf.FileBase.File))
-			backuper := storage.NewFileStorage(conf.FileBase.File, l)
-			err := backuper.Get(internalStor)
+	// в памяти поиск ссылки не дороже фильтра, он нужен только внешним хранилищам.
+	// Без уведомлений фильтр не узнает о ссылках, созданных другими экземплярами,
+	// и будет отвечать «нет» на существующие ID.
+	_, inMemory := stor.(*storage.InternalStorage)
+	if conf.Bloom.Items > 0 && !inMemory && listener == nil {
+		l.Info("Хранилище не рассылает изменения, фильтр ссылок отключён")
+	}
+	if conf.Bloom.Items > 0 && !inMemory && listener != nil {
+		filter := storage.NewFilteredRepository(stor, l, storage.BloomOptions{
+			ExpectedItems: conf.Bloom.Items,
+			FPRate:        conf.Bloom.FPRate,
+		})
+		// фильтр строится по ChangePurge от первого LISTEN: ID, записанные другими
+		// экземплярами во время обхода, придут уведомлениями
+		metrics.Publish("url_filter", func() any { return filter.FilterStats() })
+		appliers = append(appliers, filter.Apply)
+		stor = filter
+	}
+	// локальный кеш другого экземпляра продолжал бы отдавать удалённую ссылку до TTL
+	cacheSize := conf.Cache.Size
+	if cacheSize > 0 && listener == nil {
+		l.Info("Хранилище не рассылает изменения, локальный кеш редиректов отключён")
+		cacheSize = 0
+	}
+	if cacheSize > 0 || conf.Cache.Shared != "" {
+		opts := storage.CacheOptions{
+			Size:        cacheSize,
+			TTL:         conf.Cache.TTL,
+			NegativeTTL: conf.Cache.NegativeTTL,
+		}
+		if conf.Cache.Shared != "" {
+			respOpts, err := storage.ParseRESPOptions(conf.Cache.Shared)
 			if err != nil {
 				panic(err)
 			}
-			internalStor.Backuper = backuper
+			opts.Shared = storage.NewRESPClient(respOpts, l)
 		}
-		stor = internalStor
+		cache := storage.NewCachedRepository(stor, l, opts)
+		metrics.Publish("url_cache", func() any { return cache.CacheStats() })
+		appliers = append(appliers, cache.Apply)
+		stor = cache
+	}
+	if listener != nil && len(appliers) > 0 {
+		listener.Listen(ctx, func(ev storage.ChangeEvent) {
+			for _, apply := range appliers {
+				apply(ev)
+			}
+		})
+	}
+	defer func() {
+		if err := stor.Close(); err != nil {
+			l.Error("Ошибка закрытия хранилища", zap.Error(err))
+		}
+	}()
+
+	// инициализируем фоновое удаление
+	remover := usecase.NewRemover(stor, l, usecase.RemoverConfig{
+		BatchSize:        conf.DeleteQueue.BatchSize,
+		FlushInterval:    conf.DeleteQueue.FlushInterval,
+		QueueSize:        conf.DeleteQueue.Size,
+		EnqueueTimeout:   conf.DeleteQueue.EnqueueTimeout,
+		MaxRetryInterval: conf.DeleteQueue.MaxRetryInterval,
+	})
+	if err := remover.Start(ctx); err != nil {
+		panic(err)
 	}
 
 	// инициализируем URL процессор
@@ -58,6 +128,7 @@ func main() { //nolint:funlen
 		Repo:            stor,
 		Log:             l,
 		Authentificator: auth.NewAuthentificator(l, stor, conf.BaseURL, conf.SecretKey),
+		Remover:         remover,
 	}
 
 	// инициализируем сервер
@@ -70,9 +141,25 @@ func main() { //nolint:funlen
 		},
 	}
 
+	if conf.MetricsAddress != "" {
+		go func() {
+			if err := server.RunMetrics(ctx, conf.MetricsAddress, metrics, l); err != nil {
+				l.Error("Ошибка сервера метрик", zap.Error(err))
+			}
+		}()
+	}
+
 	l.Info("Running server", zap.String("address", conf.LocalAddress.String()), zap.String("loglevel", conf.LogLevel))
 
-	if err := srv.Run(conf.LocalAddress); err != nil {
-		panic(err)
+	// после Run обработчики завершены и новых задач на удаление не будет
+	if err := srv.Run(ctx, conf.LocalAddress); err != nil {
+		l.Error("Ошибка остановки сервера", zap.Error(err))
+	}
+
+	// дожидаемся выполнения поставленных задач на удаление
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := remover.Close(shutdownCtx); err != nil {
+		l.Error("Не удалось дождаться очереди удаления", zap.Error(err))
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/Taboon/urlshortner/internal/config"
+	"github.com/Taboon/urlshortner/internal/logger"
+	"github.com/Taboon/urlshortner/internal/storage"
+	"go.uber.org/zap"
+)
+
+// migrate управляет схемой базы встроенными миграциями:
+// shortener migrate -d postgres://... up|down|status|redo
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_DSN"), "storage dsn: postgres://, mysql://, sqlite://")
+	logLevel := fs.String("log", "Info", "loglevel (Info, Debug, Error)")
+	lockTimeout := fs.Duration("lock-timeout", storage.DefaultMigrationLockTimeout,
+		"max wait for migrations run by another instance (postgres)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: shortener migrate [-d dsn] up|down|status|redo")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("migrate command is required")
+	}
+	if *dsn == "" {
+		return errors.New("-d or DATABASE_DSN is required")
+	}
+
+	l, err := logger.Initialize(config.Config{LogLevel: *logLevel})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m, err := storage.NewMigrator(*dsn, storage.MigrateOptions{LockTimeout: *lockTimeout}, l)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			l.Error("Ошибка закрытия соединения миграций", zap.Error(err))
+		}
+	}()
+
+	switch cmd := fs.Arg(0); cmd {
+	case "up":
+		_, err = m.Up(ctx)
+	case "down":
+		_, err = m.Down(ctx)
+	case "redo":
+		_, err = m.Redo(ctx)
+	case "status":
+		err = printMigrationStatus(ctx, m)
+	default:
+		fs.Usage()
+		err = fmt.Errorf("unknown migrate command %q", cmd)
+	}
+	return err
+}
+
+func printMigrationStatus(ctx context.Context, m *storage.Migrator) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tAPPLIED AT\tMIGRATION")
+	for _, s := range status {
+		applied := "-"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.State, applied, filepath.Base(s.Source.Path))
+	}
+	return w.Flush()
+}
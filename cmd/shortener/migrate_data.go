@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Taboon/urlshortner/internal/config"
+	"github.com/Taboon/urlshortner/internal/domain/usecase"
+	"github.com/Taboon/urlshortner/internal/logger"
+	"github.com/Taboon/urlshortner/internal/storage"
+	"go.uber.org/zap"
+)
+
+// migrateData переносит данные между хранилищами:
+// shortener migrate-data -from file:///tmp/db.json -to postgres://...
+// Ключи зашифрованного файла бекапа берутся из FILE_STORAGE_KEY и FILE_STORAGE_OLD_KEYS.
+func migrateData(args []string) error {
+	fs := flag.NewFlagSet("migrate-data", flag.ExitOnError)
+	from := fs.String("from", "", "source storage dsn")
+	to := fs.String("to", "", "target storage dsn")
+	batch := fs.Int("batch", 1000, "urls per step")
+	checkpoint := fs.String("checkpoint", "migrate-data.checkpoint", "progress file to resume an interrupted migration (empty - off)")
+	restart := fs.Bool("restart", false, "ignore saved progress and start over (target must be empty)")
+	logLevel := fs.String("log", "Info", "loglevel (Info, Debug, Error)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New("both -from and -to are required")
+	}
+
+	l, err := logger.Initialize(config.Config{LogLevel: *logLevel})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts, err := storageOptions(os.Getenv("FILE_STORAGE_KEY"), os.Getenv("FILE_STORAGE_OLD_KEYS"))
+	if err != nil {
+		return err
+	}
+
+	src, err := storage.OpenWith(ctx, *from, opts, l)
+	if err != nil {
+		return err
+	}
+	defer closeStore(src, l)
+
+	dst, err := storage.OpenWith(ctx, *to, opts, l)
+	if err != nil {
+		return err
+	}
+	defer closeStore(dst, l)
+
+	// в файле прогресса храним хеш пары DSN, чтобы не хранить пароли
+	key := sha256.Sum256([]byte(*from + "\x00" + *to))
+	m, err := usecase.NewDataMigrator(src, dst, l, usecase.DataMigratorConfig{
+		BatchSize:     *batch,
+		Checkpoint:    *checkpoint,
+		CheckpointKey: hex.EncodeToString(key[:]),
+		Restart:       *restart,
+	})
+	if err != nil {
+		return err
+	}
+
+	progress, err := m.Run(ctx)
+	if err != nil {
+		return err
+	}
+	l.Info("Перенос завершён", zap.Int("copied", progress.Copied))
+	return nil
+}
+
+func closeStore(s storage.Store, l *zap.Logger) {
+	if err := s.Close(); err != nil {
+		l.Error("Ошибка закрытия хранилища", zap.Error(err))
+	}
+}
+
+// storageOptions разбирает ключи шифрования файла бекапа
+func storageOptions(key, oldKeys string) (storage.Options, error) {
+	var opts storage.Options
+	var err error
+	if opts.FileKey, err = storage.ParseKey(key); err != nil {
+		return opts, err
+	}
+	if opts.FileOldKeys, err = storage.ParseKeys(oldKeys); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -14,6 +18,42 @@ type Config struct {
 	DataBase     string
 	LogLevel     string
 	SecretKey    string
+	DeleteQueue  DeleteQueue
+	Cache        Cache
+	Bloom        Bloom
+	// DataBaseReplicas DSN реплик Postgres для чтения через запятую
+	DataBaseReplicas string
+	// AutoMigrate применять миграции схемы при старте, иначе только shortener migrate up
+	AutoMigrate bool
+	// MigrateLockTimeout сколько ждать миграций, которые выполняет другой экземпляр
+	MigrateLockTimeout time.Duration
+	// MetricsAddress служебный адрес метрик, пустой — метрики не отдаются
+	MetricsAddress string
+}
+
+// Bloom настройки фильтра коротких ссылок
+type Bloom struct {
+	Items  int
+	FPRate float64
+}
+
+// Cache настройки кеша редиректов
+type Cache struct {
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// Shared DSN общего кеша redis://, пустой — без общего кеша
+	Shared string
+}
+
+// DeleteQueue настройки фоновой очереди удаления ссылок
+type DeleteQueue struct {
+	BatchSize      int
+	FlushInterval  time.Duration
+	Size           int
+	EnqueueTimeout time.Duration
+	// MaxRetryInterval верхняя граница паузы между повторами неудавшейся пачки
+	MaxRetryInterval time.Duration
 }
 
 type Builder interface {
@@ -81,17 +121,49 @@ func (c *Config) URL() string {
 	return fmt.Sprintf("%v:%v", c.LocalAddress.IP, strconv.Itoa(c.LocalAddress.Port))
 }
 
+// StorageDSN выбирает хранилище: DSN из -d, иначе память с бекапом в файл, иначе только память
+func (c *Config) StorageDSN() string {
+	switch {
+	case c.DataBase != "":
+		return c.DataBase + c.replicaParams()
+	case c.FileBase.File != "":
+		return c.FileBase.DSN()
+	default:
+		return "memory://"
+	}
+}
+
+// replicaParams параметры replica для DSN Postgres. Реплики передаются только
+// в DSN вида postgres://, в формат key=value их не добавить.
+func (c *Config) replicaParams() string {
+	if c.DataBaseReplicas == "" || !strings.Contains(c.DataBase, "://") {
+		return ""
+	}
+	q := url.Values{}
+	for _, r := range strings.Split(c.DataBaseReplicas, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			q.Add("replica", r)
+		}
+	}
+	sep := "?"
+	if strings.Contains(c.DataBase, "?") {
+		sep = "&"
+	}
+	return sep + q.Encode()
+}
+
+// parseEnv читает переменные окружения. Ошибочная переменная не мешает
+// прочитать остальные, ошибки возвращаются вместе.
 func parseEnv(conf *Config) error {
+	var errs []error
 	if envRunAddr := os.Getenv("SERVER_ADDRESS"); envRunAddr != "" {
-		err := conf.LocalAddress.Set(envRunAddr)
-		if err != nil {
-			return err
+		if err := conf.LocalAddress.Set(envRunAddr); err != nil {
+			errs = append(errs, fmt.Errorf("SERVER_ADDRESS: %w", err))
 		}
 	}
 	if envBasePath := os.Getenv("BASE_URL"); envBasePath != "" {
-		err := conf.BaseURL.Set(envBasePath)
-		if err != nil {
-			return err
+		if err := conf.BaseURL.Set(envBasePath); err != nil {
+			errs = append(errs, fmt.Errorf("BASE_URL: %w", err))
 		}
 	}
 	if envBasePath := os.Getenv("FILE_STORAGE_PATH"); envBasePath != "" {
@@ -100,24 +172,71 @@ func parseEnv(conf *Config) error {
 	if envDBAddres := os.Getenv("DATABASE_DSN"); envDBAddres != "" {
 		conf.DataBase = envDBAddres
 	}
+	if replicas := os.Getenv("DATABASE_REPLICA_DSN"); replicas != "" {
+		conf.DataBaseReplicas = replicas
+	}
 	if secretKey := os.Getenv("SECRET_KEY"); secretKey != "" {
 		conf.SecretKey = secretKey
 	}
+	if key := os.Getenv("FILE_STORAGE_KEY"); key != "" {
+		conf.FileBase.Key = key
+	}
+	if keys := os.Getenv("FILE_STORAGE_OLD_KEYS"); keys != "" {
+		conf.FileBase.OldKeys = keys
+	}
+	if metrics := os.Getenv("METRICS_ADDRESS"); metrics != "" {
+		conf.MetricsAddress = metrics
+	}
+	if shared := os.Getenv("CACHE_SHARED_DSN"); shared != "" {
+		conf.Cache.Shared = shared
+	}
+	if auto := os.Getenv("AUTO_MIGRATE"); auto != "" {
+		if v, err := strconv.ParseBool(auto); err != nil {
+			errs = append(errs, fmt.Errorf("AUTO_MIGRATE: %w", err))
+		} else {
+			conf.AutoMigrate = v
+		}
+	}
+	if sync := os.Getenv("FILE_STORAGE_SYNC"); sync != "" {
+		conf.FileBase.Sync = sync
+	}
 	if fileBase := os.Getenv("TMP_FILE_BASE"); fileBase != "" {
-		err := conf.FileBase.Set(fileBase)
-		if err != nil {
-			return err
+		if err := conf.FileBase.Set(fileBase); err != nil {
+			errs = append(errs, fmt.Errorf("TMP_FILE_BASE: %w", err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func parseFlags(conf *Config) error {
 	flag.Var(&conf.BaseURL, "b", "address to make short url")
-	flag.StringVar(&conf.DataBase, "d", "", "data base url")
+	flag.StringVar(&conf.DataBase, "d", "", "storage dsn: postgres://, mysql://, sqlite://, bolt://, file://, memory://")
+	flag.StringVar(&conf.DataBaseReplicas, "d-replicas", "",
+		"comma separated postgres:// replica dsns for reads (pool, health and read_your_writes params are set in -d)")
 	flag.Var(&conf.LocalAddress, "a", "address to start server")
 	flag.Var(&conf.FileBase, "f", "file base path")
+	flag.IntVar(&conf.FileBase.CompactThreshold, "f-compact-records", 10000, "compact file base after this many appended records (0 - off)")
+	flag.DurationVar(&conf.FileBase.CompactInterval, "f-compact-interval", 0, "compact file base periodically (0 - off)")
+	flag.StringVar(&conf.FileBase.Sync, "f-sync", "always",
+		"file base fsync mode: always - fsync every group commit, interval - fsync every f-sync-interval, none - leave it to the OS")
+	flag.DurationVar(&conf.FileBase.SyncInterval, "f-sync-interval", 100*time.Millisecond, "file base fsync period in interval mode")
+	flag.StringVar(&conf.FileBase.Encoding, "f-encoding", "jsonl", "file base record encoding (jsonl, binary)")
 	flag.StringVar(&conf.LogLevel, "log", "Debug", "loglevel (Info, Debug, Error)")
+	flag.IntVar(&conf.DeleteQueue.BatchSize, "delete-batch", 100, "delete queue batch size")
+	flag.DurationVar(&conf.DeleteQueue.FlushInterval, "delete-interval", time.Second, "delete queue flush interval")
+	flag.IntVar(&conf.DeleteQueue.Size, "delete-queue", 1000, "delete queue size")
+	flag.DurationVar(&conf.DeleteQueue.EnqueueTimeout, "delete-wait", time.Second, "max wait for free space in delete queue")
+	flag.DurationVar(&conf.DeleteQueue.MaxRetryInterval, "delete-retry-max", time.Minute, "max backoff between retries of a failed delete batch")
+	flag.IntVar(&conf.Cache.Size, "cache-size", 10000, "redirect cache size (0 - off); used only with storages that publish changes (postgres)")
+	flag.DurationVar(&conf.Cache.TTL, "cache-ttl", 10*time.Minute, "redirect cache ttl (0 - until evicted)")
+	flag.DurationVar(&conf.Cache.NegativeTTL, "cache-negative-ttl", 10*time.Second, "how long unknown ids are cached (0 - off)")
+	flag.IntVar(&conf.Bloom.Items, "bloom-items", 1000000, "expected short url count for bloom filter (0 - off)")
+	flag.Float64Var(&conf.Bloom.FPRate, "bloom-fp", 0.01, "bloom filter target false positive rate")
+	flag.StringVar(&conf.Cache.Shared, "cache-shared", "",
+		"shared redirect cache dsn: redis://[:password@]host:port[/db]?pool_size=10&read_timeout=100ms&breaker_failures=5")
+	flag.BoolVar(&conf.AutoMigrate, "auto-migrate", true, "apply schema migrations at startup (false - only shortener migrate up)")
+	flag.DurationVar(&conf.MigrateLockTimeout, "migrate-lock-timeout", 5*time.Minute, "max wait for migrations run by another instance (postgres)")
+	flag.StringVar(&conf.MetricsAddress, "metrics-a", "", "internal address for /debug/vars metrics, e.g. localhost:9090 (empty - off)")
 	flag.Parse()
 	return nil
 }
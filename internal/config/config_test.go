@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -40,3 +41,51 @@ func TestBuildConfig(t *testing.T) {
 		t.Errorf("Expected log level to be debug, got %s", conf.LogLevel)
 	}
 }
+
+func TestStorageDSN(t *testing.T) {
+	conf := &Config{}
+	if dsn := conf.StorageDSN(); dsn != "memory://" {
+		t.Errorf("Expected memory storage, got %s", dsn)
+	}
+
+	conf.FileBase = FileBase{File: "/tmp/db.json", CompactThreshold: 100, Sync: "none", Encoding: "binary"}
+	if dsn := conf.StorageDSN(); dsn != "file:///tmp/db.json?compact_records=100&encoding=binary&sync=none" {
+		t.Errorf("Unexpected file storage dsn %s", dsn)
+	}
+
+	// ключи в DSN не попадают, спецсимволы пути экранируются
+	conf.FileBase = FileBase{File: "/tmp/my db?#.json", Key: "00112233445566778899aabbccddeeff"}
+	if dsn := conf.StorageDSN(); dsn != "file:///tmp/my%20db%3F%23.json?compact_records=0" {
+		t.Errorf("Unexpected file storage dsn %s", dsn)
+	}
+
+	conf.DataBase = "sqlite:///tmp/db.sqlite"
+	if dsn := conf.StorageDSN(); dsn != conf.DataBase {
+		t.Errorf("Expected %s, got %s", conf.DataBase, dsn)
+	}
+
+	conf.DataBase = "postgres://u:p@primary/db?read_your_writes=2s"
+	conf.DataBaseReplicas = "postgres://u:p@r1/db, postgres://u:p@r2/db"
+	expected := "postgres://u:p@primary/db?read_your_writes=2s&replica=postgres%3A%2F%2Fu%3Ap%40r1%2Fdb&replica=postgres%3A%2F%2Fu%3Ap%40r2%2Fdb"
+	if dsn := conf.StorageDSN(); dsn != expected {
+		t.Errorf("Expected %s, got %s", expected, dsn)
+	}
+}
+
+func TestParseEnvContinuesAfterError(t *testing.T) {
+	t.Setenv("AUTO_MIGRATE", "maybe")
+	t.Setenv("FILE_STORAGE_SYNC", "none")
+
+	conf := &Config{AutoMigrate: true}
+	err := parseEnv(conf)
+	if err == nil || !strings.Contains(err.Error(), "AUTO_MIGRATE") {
+		t.Errorf("Expected AUTO_MIGRATE error, got %v", err)
+	}
+	if !conf.AutoMigrate {
+		t.Errorf("Invalid AUTO_MIGRATE must keep the previous value")
+	}
+	// переменные после ошибочной всё равно читаются
+	if conf.FileBase.Sync != "none" {
+		t.Errorf("Expected FILE_STORAGE_SYNC to be read, got %q", conf.FileBase.Sync)
+	}
+}
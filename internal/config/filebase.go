@@ -1,7 +1,28 @@
 package config
 
+import (
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
 type FileBase struct {
 	File string
+	// CompactThreshold количество записей в хвосте файла, после которого он сжимается в снимок
+	CompactThreshold int
+	// CompactInterval период фонового сжатия файла
+	CompactInterval time.Duration
+	// Sync режим сброса на диск: always, interval или none
+	Sync string
+	// SyncInterval период fsync в режиме interval
+	SyncInterval time.Duration
+	// Encoding формат записей: jsonl или binary
+	Encoding string
+	// Key ключ шифрования записей (hex или base64), задаётся только через окружение
+	Key string
+	// OldKeys прежние ключи через запятую, нужны для чтения файла после ротации ключа
+	OldKeys string
 }
 
 func (f *FileBase) String() string {
@@ -16,3 +37,30 @@ func (f *FileBase) Set(flagValue string) error {
 	f.File = flagValue
 	return nil
 }
+
+// DSN строка подключения хранилища с бекапом в файл, настройки передаются параметрами.
+// Ключи шифрования в DSN не попадают, их передаёт вызывающий через storage.Options.
+func (f *FileBase) DSN() string {
+	q := url.Values{}
+	q.Set("compact_records", strconv.Itoa(f.CompactThreshold))
+	if f.CompactInterval > 0 {
+		q.Set("compact_interval", f.CompactInterval.String())
+	}
+	if f.Sync != "" {
+		q.Set("sync", f.Sync)
+	}
+	if f.SyncInterval > 0 {
+		q.Set("sync_interval", f.SyncInterval.String())
+	}
+	if f.Encoding != "" {
+		q.Set("encoding", f.Encoding)
+	}
+
+	// относительный путь в DSN читался бы как хост, поэтому передаём абсолютный
+	path := f.File
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path), RawQuery: q.Encode()}
+	return u.String()
+}
@@ -0,0 +1,206 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Taboon/urlshortner/internal/storage"
+	"go.uber.org/zap"
+)
+
+var ErrMigrationUnsupported = errors.New("storage does not support data migration")
+var ErrCheckpointMismatch = errors.New("checkpoint belongs to another migration")
+var ErrMigrationMismatch = errors.New("data counts differ after migration")
+var ErrTargetNotEmpty = errors.New("target storage is not empty")
+
+// DataMigratorConfig настройки переноса данных между хранилищами
+type DataMigratorConfig struct {
+	// BatchSize количество ссылок, переносимых за один шаг
+	BatchSize int
+	// Checkpoint файл, в котором после каждого шага сохраняется прогресс. Пустой путь отключает продолжение.
+	Checkpoint string
+	// CheckpointKey отличает перенос между одной парой хранилищ от переноса между другой
+	CheckpointKey string
+	// Restart начинает перенос заново, не глядя на сохранённый прогресс
+	Restart bool
+}
+
+// MigrationProgress состояние переноса, оно же содержимое файла прогресса
+type MigrationProgress struct {
+	Key       string `json:"key"`
+	UsersDone bool   `json:"users_done"`
+	LastID    string `json:"last_id"`
+	Copied    int    `json:"copied"`
+	Total     int    `json:"total"`
+}
+
+// DataMigrator переносит пользователей и ссылки из одного хранилища в другое.
+// Ссылки читаются страницами по возрастанию ID, поэтому после остановки перенос
+// продолжается с последней сохранённой страницы. Источник может продолжать работать.
+type DataMigrator struct {
+	from storage.Exporter
+	to   storage.Importer
+	log  *zap.Logger
+	conf DataMigratorConfig
+}
+
+func NewDataMigrator(from, to storage.Repository, log *zap.Logger, conf DataMigratorConfig) (*DataMigrator, error) {
+	exporter, ok := from.(storage.Exporter)
+	if !ok {
+		return nil, fmt.Errorf("source: %w", ErrMigrationUnsupported)
+	}
+	importer, ok := to.(storage.Importer)
+	if !ok {
+		return nil, fmt.Errorf("target: %w", ErrMigrationUnsupported)
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 1000
+	}
+	return &DataMigrator{from: exporter, to: importer, log: log, conf: conf}, nil
+}
+
+// Run переносит данные и сверяет количество ссылок в источнике и приёмнике.
+// Новый перенос выполняется только в пустой приёмник: иначе сверка сравнивала бы
+// источник с чужими данными.
+func (m *DataMigrator) Run(ctx context.Context) (MigrationProgress, error) {
+	progress, err := m.loadCheckpoint()
+	if err != nil {
+		return progress, err
+	}
+	if !progress.UsersDone {
+		if err := m.checkTargetEmpty(ctx); err != nil {
+			return progress, err
+		}
+	}
+
+	src, err := m.from.Stats(ctx)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = src.URLs
+	if progress.Copied > 0 {
+		m.log.Info("Продолжаем перенос", zap.String("after", progress.LastID), zap.Int("copied", progress.Copied))
+	}
+
+	// пользователей создаём первыми: ссылки в приёмнике ссылаются на них
+	if !progress.UsersDone {
+		if err := m.to.ImportUsers(ctx, src.LastUserID); err != nil {
+			return progress, err
+		}
+		progress.UsersDone = true
+		if err := m.saveCheckpoint(progress); err != nil {
+			return progress, err
+		}
+		m.log.Info("Перенесли пользователей", zap.Int("last_user_id", src.LastUserID))
+	}
+
+	for {
+		records, err := m.from.ExportURLs(ctx, progress.LastID, m.conf.BatchSize)
+		if err != nil {
+			return progress, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		if err := m.to.ImportURLs(ctx, records); err != nil {
+			return progress, err
+		}
+
+		progress.LastID = records[len(records)-1].ID
+		progress.Copied += len(records)
+		if err := m.saveCheckpoint(progress); err != nil {
+			return progress, err
+		}
+		m.log.Info("Перенесли ссылки", zap.Int("copied", progress.Copied), zap.Int("total", progress.Total))
+	}
+
+	if err := m.verify(ctx); err != nil {
+		return progress, err
+	}
+	if m.conf.Checkpoint != "" {
+		if err := os.Remove(m.conf.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return progress, err
+		}
+	}
+	return progress, nil
+}
+
+// checkTargetEmpty проверяет, что в приёмнике нет ссылок
+func (m *DataMigrator) checkTargetEmpty(ctx context.Context) error {
+	dst, err := m.to.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if dst.URLs > 0 || dst.Deleted > 0 {
+		return fmt.Errorf("%w: %d urls, %d deleted; migrate into an empty storage or resume with the checkpoint",
+			ErrTargetNotEmpty, dst.URLs, dst.Deleted)
+	}
+	return nil
+}
+
+// verify сравнивает количество ссылок. Пока источник принимает запросы,
+// расхождение возможно, тогда перенос стоит повторить.
+func (m *DataMigrator) verify(ctx context.Context) error {
+	src, err := m.from.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	dst, err := m.to.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.log.Info("Сверяем данные",
+		zap.Int("source_urls", src.URLs), zap.Int("target_urls", dst.URLs),
+		zap.Int("source_deleted", src.Deleted), zap.Int("target_deleted", dst.Deleted),
+		zap.Int("source_last_user", src.LastUserID), zap.Int("target_last_user", dst.LastUserID))
+
+	if src.URLs != dst.URLs || src.Deleted != dst.Deleted || src.LastUserID > dst.LastUserID {
+		return fmt.Errorf("%w: source %+v, target %+v", ErrMigrationMismatch, src, dst)
+	}
+	return nil
+}
+
+func (m *DataMigrator) loadCheckpoint() (MigrationProgress, error) {
+	progress := MigrationProgress{Key: m.conf.CheckpointKey}
+	if m.conf.Checkpoint == "" || m.conf.Restart {
+		return progress, nil
+	}
+
+	data, err := os.ReadFile(m.conf.Checkpoint)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return progress, err
+	}
+
+	var saved MigrationProgress
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return progress, err
+	}
+	if saved.Key != m.conf.CheckpointKey {
+		return progress, ErrCheckpointMismatch
+	}
+	return saved, nil
+}
+
+// saveCheckpoint атомарно перезаписывает файл прогресса
+func (m *DataMigrator) saveCheckpoint(progress MigrationProgress) error {
+	if m.conf.Checkpoint == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	tmpName := m.conf.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmpName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, m.conf.Checkpoint)
+}
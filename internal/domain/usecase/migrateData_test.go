@@ -0,0 +1,136 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Taboon/urlshortner/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var errImportFailed = errors.New("import failed")
+
+// failingImporter прерывает перенос на заданном шаге
+type failingImporter struct {
+	storage.Store
+	failAt int
+	calls  int
+}
+
+func (f *failingImporter) Stats(ctx context.Context) (storage.Stats, error) {
+	return f.Store.(storage.Importer).Stats(ctx)
+}
+
+func (f *failingImporter) ImportUsers(ctx context.Context, lastUserID int) error {
+	return f.Store.(storage.Importer).ImportUsers(ctx, lastUserID)
+}
+
+func (f *failingImporter) ImportURLs(ctx context.Context, records []storage.Record) error {
+	f.calls++
+	if f.calls == f.failAt {
+		return errImportFailed
+	}
+	return f.Store.(storage.Importer).ImportURLs(ctx, records)
+}
+
+func newMigrationSource(t *testing.T) *storage.InternalStorage {
+	ctx := context.Background()
+	src := storage.NewMemoryStorage(zap.NewNop())
+	for i := 0; i < 3; i++ {
+		_, err := src.GetNewUser(ctx)
+		require.NoError(t, err)
+	}
+
+	owner := context.WithValue(ctx, storage.UserID, 1)
+	for _, d := range []storage.URLData{{ID: "AAAAaaaa", URL: "http://a.ru"}, {ID: "BBBBbbbb", URL: "http://b.ru"}, {ID: "CCCCcccc", URL: "http://c.ru"}} {
+		require.NoError(t, src.AddURL(owner, d))
+	}
+	require.NoError(t, src.RemoveURL(owner, []storage.URLData{{ID: "BBBBbbbb"}}))
+
+	other := context.WithValue(ctx, storage.UserID, 2)
+	for _, d := range []storage.URLData{{ID: "DDDDdddd", URL: "http://d.ru"}, {ID: "EEEEeeee", URL: "http://e.ru"}} {
+		require.NoError(t, src.AddURL(other, d))
+	}
+	return src
+}
+
+func TestDataMigratorResumes(t *testing.T) {
+	targets := map[string]func(dir string) string{
+		"sqlite": func(dir string) string { return "sqlite://" + filepath.Join(dir, "db.sqlite") },
+		"bolt":   func(dir string) string { return "bolt://" + filepath.Join(dir, "db.bolt") },
+		"file":   func(dir string) string { return "file://" + filepath.Join(dir, "db.json") },
+	}
+
+	for name, dsn := range targets {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			src := newMigrationSource(t)
+			dst, err := storage.Open(ctx, dsn(dir), zap.NewNop())
+			require.NoError(t, err)
+			defer dst.Close()
+
+			conf := DataMigratorConfig{BatchSize: 2, Checkpoint: filepath.Join(dir, "checkpoint"), CheckpointKey: "test"}
+
+			m, err := NewDataMigrator(src, &failingImporter{Store: dst, failAt: 2}, zap.NewNop(), conf)
+			require.NoError(t, err)
+			progress, err := m.Run(ctx)
+			require.ErrorIs(t, err, errImportFailed)
+			assert.Equal(t, 2, progress.Copied)
+
+			m, err = NewDataMigrator(src, dst, zap.NewNop(), conf)
+			require.NoError(t, err)
+			progress, err = m.Run(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 5, progress.Copied)
+			assert.NoFileExists(t, conf.Checkpoint)
+
+			urls, err := dst.GetURLsByUser(ctx, 1)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, storage.UserURLs{
+				{ID: "AAAAaaaa", URL: "http://a.ru"},
+				{ID: "BBBBbbbb", URL: "http://b.ru", Deleted: true},
+				{ID: "CCCCcccc", URL: "http://c.ru"},
+			}, urls)
+
+			next, err := dst.GetNewUser(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 4, next, "новые пользователи получают ID после перенесённых")
+		})
+	}
+}
+
+func TestDataMigratorCheckpointMismatch(t *testing.T) {
+	dir := t.TempDir()
+	conf := DataMigratorConfig{BatchSize: 2, Checkpoint: filepath.Join(dir, "checkpoint"), CheckpointKey: "first"}
+	m, err := NewDataMigrator(newMigrationSource(t), &failingImporter{Store: storage.NewMemoryStorage(zap.NewNop()), failAt: 1}, zap.NewNop(), conf)
+	require.NoError(t, err)
+	_, err = m.Run(context.Background())
+	require.ErrorIs(t, err, errImportFailed)
+
+	conf.CheckpointKey = "second"
+	m, err = NewDataMigrator(newMigrationSource(t), storage.NewMemoryStorage(zap.NewNop()), zap.NewNop(), conf)
+	require.NoError(t, err)
+	_, err = m.Run(context.Background())
+	assert.ErrorIs(t, err, ErrCheckpointMismatch)
+}
+
+func TestDataMigratorRefusesNonEmptyTarget(t *testing.T) {
+	ctx := context.Background()
+	dst := storage.NewMemoryStorage(zap.NewNop())
+	require.NoError(t, dst.AddURL(context.WithValue(ctx, storage.UserID, 1), storage.URLData{ID: "ZZZZzzzz", URL: "http://z.ru"}))
+
+	m, err := NewDataMigrator(newMigrationSource(t), dst, zap.NewNop(), DataMigratorConfig{BatchSize: 2})
+	require.NoError(t, err)
+	progress, err := m.Run(ctx)
+	require.ErrorIs(t, err, ErrTargetNotEmpty)
+	assert.Zero(t, progress.Copied)
+
+	_, ok, err := dst.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	assert.False(t, ok, "в непустой приёмник ничего не переносится")
+}
@@ -11,4 +11,5 @@ type URLProcessor struct {
 	Repo            storage.Repository
 	Authentificator auth.Autentificator
 	Log             *zap.Logger
+	Remover         *Remover
 }
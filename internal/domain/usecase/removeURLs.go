@@ -2,133 +2,302 @@ package usecase
 
 import (
 	"context"
-	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Taboon/urlshortner/internal/entity"
 	"github.com/Taboon/urlshortner/internal/storage"
 	"go.uber.org/zap"
-	"net/http"
-	"sync"
 )
 
-func (u *URLProcessor) RemoveURLs(requestBody []string, r *http.Request) {
-	doneCh := make(chan struct{})
+// RemoverConfig настройки фонового удаления ссылок
+type RemoverConfig struct {
+	// BatchSize размер пачки, при достижении которого она сразу отправляется в хранилище
+	BatchSize int
+	// FlushInterval максимальное время, которое задача ждёт в неполной пачке
+	FlushInterval time.Duration
+	// QueueSize размер очереди задач
+	QueueSize int
+	// EnqueueTimeout сколько запрос ждёт места в заполненной очереди
+	EnqueueTimeout time.Duration
+	// MaxRetryInterval верхняя граница паузы перед повтором неудавшейся пачки.
+	// Пауза начинается с FlushInterval и удваивается после каждой неудачи.
+	MaxRetryInterval time.Duration
+}
+
+// Remover долгоживущий сервис удаления ссылок.
+// Собирает задачи от разных запросов в пачки и применяет их к хранилищу
+// независимо от жизни HTTP запроса. Если хранилище реализует storage.DeleteJournal,
+// задачи сохраняются в нём до выполнения и повторяются после перезапуска.
+type Remover struct {
+	repo    storage.Repository
+	journal storage.DeleteJournal
+	log     *zap.Logger
+	conf    RemoverConfig
 
-	inputCh := u.generator(doneCh, requestBody)
-	channels := u.fanOut(r.Context(), doneCh, inputCh)
-	addResultCh := u.fanIn(doneCh, channels...)
-	u.remover(r.Context(), doneCh, addResultCh)
+	tasks chan storage.DeleteTask
+	done  chan struct{}
+
+	mu     sync.RWMutex // защищает closed и отправку в tasks
+	closed bool
 }
 
-func (u *URLProcessor) generator(doneCh chan struct{}, input []string) chan string {
-	genChan := make(chan string)
-	u.Log.Debug("Открыли канал genChan")
-	go func() {
-		defer func() {
-			u.Log.Debug("Закрыли канал genChan")
-			close(genChan)
-		}()
-		fmt.Println(input)
-
-		for _, data := range input {
-			select {
-			case <-doneCh:
-				u.Log.Debug("Получили DONE")
-				return
-			case genChan <- data:
-				u.Log.Debug("Отправили в канал genChan", zap.String("data", data))
-			}
+func NewRemover(repo storage.Repository, log *zap.Logger, conf RemoverConfig) *Remover {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = time.Second
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 1000
+	}
+	if conf.MaxRetryInterval < conf.FlushInterval {
+		conf.MaxRetryInterval = max(time.Minute, conf.FlushInterval)
+	}
+
+	rm := &Remover{
+		repo:  repo,
+		log:   log,
+		conf:  conf,
+		tasks: make(chan storage.DeleteTask, conf.QueueSize),
+		done:  make(chan struct{}),
+	}
+	if j, ok := repo.(storage.DeleteJournal); ok {
+		rm.journal = j
+	}
+	return rm
+}
+
+// Start загружает невыполненные задачи из журнала и запускает обработку очереди
+func (rm *Remover) Start(ctx context.Context) error {
+	var pending []storage.DeleteTask
+	if rm.journal != nil {
+		var err error
+		pending, err = rm.journal.PendingDeletes(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			rm.log.Info("Восстановили задачи на удаление из журнала", zap.Int("count", len(pending)))
 		}
-	}()
+	}
 
-	return genChan
+	go rm.run(pending)
+	return nil
 }
 
-func (u *URLProcessor) remover(ctx context.Context, doneCh chan struct{}, idToRemove chan storage.URLData) {
-	u.Log.Debug("remover начал работу")
-	go func() {
-		defer func() {
-			close(doneCh)
-			u.Log.Debug("Закрыли канал DONE")
-		}()
+// Enqueue ставит задачи в очередь. Если очередь заполнена дольше EnqueueTimeout,
+// возвращает entity.ErrDeleteQueueFull.
+func (rm *Remover) Enqueue(ctx context.Context, tasks []storage.DeleteTask) error {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
 
-		var batch = make([]storage.URLData, 0)
+	if rm.closed {
+		return entity.ErrRemoverClosed
+	}
 
-		for data := range idToRemove {
-			batch = append(batch, data)
-			u.Log.Debug("Добавили в batch", zap.String("id", data.ID))
+	if rm.journal != nil {
+		if err := rm.journal.AppendDeletes(ctx, tasks); err != nil {
+			return err
 		}
+	}
 
-		u.Log.Debug("Подготовили batch", zap.Any("batch", batch))
-		err := u.Repo.RemoveURL(ctx, batch)
-		if err != nil {
-			u.Log.Error("Ошибка удаления URL", zap.Error(err))
+	for i, t := range tasks {
+		if err := rm.push(ctx, t); err != nil {
+			rm.forget(ctx, tasks[i:])
+			return err
 		}
-	}()
+	}
+	return nil
+}
+
+func (rm *Remover) push(ctx context.Context, t storage.DeleteTask) error {
+	select {
+	case rm.tasks <- t:
+		return nil
+	default:
+	}
+
+	if rm.conf.EnqueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rm.conf.EnqueueTimeout)
+		defer cancel()
+	}
+
+	select {
+	case rm.tasks <- t:
+		return nil
+	case <-ctx.Done():
+		rm.log.Error("Очередь удаления заполнена")
+		return entity.ErrDeleteQueueFull
+	}
+}
+
+// forget убирает из журнала задачи, которые не удалось поставить в очередь,
+// чтобы они не выполнились после перезапуска без ведома клиента
+func (rm *Remover) forget(ctx context.Context, tasks []storage.DeleteTask) {
+	if rm.journal == nil {
+		return
+	}
+	if err := rm.journal.AckDeletes(context.WithoutCancel(ctx), tasks); err != nil {
+		rm.log.Error("Ошибка очистки журнала удалений", zap.Error(err))
+	}
 }
 
-func (u *URLProcessor) fanOut(ctx context.Context, doneCh chan struct{}, inputCh chan string) []chan storage.URLData {
-	numWorkers := 5
-	channels := make([]chan storage.URLData, numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		addResultCh := u.checkID(ctx, doneCh, inputCh)
-		channels[i] = addResultCh
+// Close перестаёт принимать задачи и дожидается выполнения уже поставленных
+func (rm *Remover) Close(ctx context.Context) error {
+	rm.mu.Lock()
+	if !rm.closed {
+		rm.closed = true
+		close(rm.tasks)
+	}
+	rm.mu.Unlock()
+
+	select {
+	case <-rm.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return channels
 }
 
-func (u *URLProcessor) checkID(ctx context.Context, doneCh chan struct{}, in chan string) chan storage.URLData {
-	checkIDout := make(chan storage.URLData)
-	go func() {
-		defer func() {
-			u.Log.Debug("Закрыли канал checkIDout")
-			close(checkIDout)
-		}()
-
-		for data := range in {
-			url, ok, err := u.Repo.CheckID(ctx, data)
-			if err != nil {
-				u.Log.Error("ошибка при проверке ID", zap.Error(err))
+func (rm *Remover) run(batch []storage.DeleteTask) {
+	defer close(rm.done)
+
+	ticker := time.NewTicker(rm.conf.FlushInterval)
+	defer ticker.Stop()
+
+	// неудавшиеся задачи копятся отдельно и повторяются с растущей паузой,
+	// чтобы недоступное хранилище не получало запрос на каждый тик
+	var (
+		retry   []storage.DeleteTask
+		delay   time.Duration
+		retryAt time.Time
+	)
+	postpone := func(failed []storage.DeleteTask) {
+		if len(failed) == 0 {
+			return
+		}
+		// повтор уже запланирован, новые неудачи ждут вместе с ним
+		waiting := len(retry) > 0
+		retry = append(retry, failed...)
+		if waiting {
+			return
+		}
+		delay = min(max(2*delay, rm.conf.FlushInterval), rm.conf.MaxRetryInterval)
+		retryAt = time.Now().Add(delay)
+		rm.log.Warn("Повторим удаление позже", zap.Int("count", len(retry)), zap.Duration("delay", delay))
+	}
+
+	for {
+		select {
+		case t, ok := <-rm.tasks:
+			if !ok {
+				rm.log.Debug("Очередь удаления закрыта, отправляем остаток")
+				if failed := rm.flush(append(batch, retry...)); len(failed) > 0 {
+					rm.log.Error("Не удалось выполнить задачи на удаление, они останутся в журнале", zap.Int("count", len(failed)))
+				}
+				return
 			}
-			u.Log.Debug("Получили инфу по id", zap.String("id", data), zap.Bool("ok", ok), zap.Any("url", url))
-			if ok {
-				select {
-				case <-doneCh:
-					return
-				case checkIDout <- url:
-					u.Log.Debug("Отправили инфу в канал checkIDout")
+			batch = append(batch, t)
+			if len(batch) >= rm.conf.BatchSize {
+				postpone(rm.flush(batch))
+				batch = nil
+			}
+		case now := <-ticker.C:
+			postpone(rm.flush(batch))
+			batch = nil
+			if len(retry) > 0 && !now.Before(retryAt) {
+				tasks := retry
+				retry = nil
+				failed := rm.flush(tasks)
+				if len(failed) == 0 {
+					delay = 0
 				}
+				postpone(failed)
 			}
 		}
-	}()
-	return checkIDout
+	}
 }
 
-func (u *URLProcessor) fanIn(doneCh chan struct{}, resultChs ...chan storage.URLData) chan storage.URLData {
-	finalCh := make(chan storage.URLData)
+// flush применяет пачку к хранилищу и возвращает задачи, которые нужно повторить
+func (rm *Remover) flush(batch []storage.DeleteTask) []storage.DeleteTask {
+	if len(batch) == 0 {
+		return batch
+	}
+	rm.log.Debug("Удаляем пачку URL", zap.Int("size", len(batch)))
+
+	byUser := make(map[int]storage.UserURLs)
+	for _, t := range batch {
+		byUser[t.UserID] = append(byUser[t.UserID], storage.URLData{ID: t.ID})
+	}
+
+	failed := make([]storage.DeleteTask, 0)
+	done := make([]storage.DeleteTask, 0, len(batch))
+	for userID, urls := range byUser {
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), storage.UserID, userID), 5*time.Second)
+		err := rm.repo.RemoveURL(ctx, urls)
+		cancel()
 
-	var wg sync.WaitGroup
+		tasks := make([]storage.DeleteTask, 0, len(urls))
+		for _, u := range urls {
+			tasks = append(tasks, storage.DeleteTask{ID: u.ID, UserID: userID})
+		}
+		if err != nil {
+			rm.log.Error("Ошибка удаления URL", zap.Int("user", userID), zap.Error(err))
+			failed = append(failed, tasks...)
+			continue
+		}
+		done = append(done, tasks...)
+	}
 
-	for _, ch := range resultChs {
-		chClosure := ch
+	if rm.journal != nil && len(done) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := rm.journal.AckDeletes(ctx, done); err != nil {
+			rm.log.Error("Ошибка очистки журнала удалений", zap.Error(err))
+		}
+		cancel()
+	}
+	return failed
+}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+// RemoveURLs ставит в очередь удаление ссылок текущего пользователя.
+// Идентификаторы, которые пользователю не принадлежат, в очередь не попадают
+// и возвращаются вызывающему.
+func (u *URLProcessor) RemoveURLs(ctx context.Context, ids []string) ([]string, error) {
+	if u.Remover == nil {
+		return nil, entity.ErrRemoverClosed
+	}
+	userID, ok := ctx.Value(storage.UserID).(int)
+	if !ok || userID == 0 {
+		return nil, entity.ErrUnknownUser
+	}
 
-			for data := range chClosure {
-				select {
-				case <-doneCh:
-					return
-				case finalCh <- data:
-					u.Log.Debug("Отправляем в канал fanIn", zap.String("id", data.ID))
-				}
-			}
-		}()
+	ownedIDs, err := u.Repo.OwnedIDs(ctx, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]struct{}, len(ownedIDs))
+	for _, id := range ownedIDs {
+		owned[id] = struct{}{}
+	}
+
+	tasks := make([]storage.DeleteTask, 0, len(ids))
+	notOwned := make([]string, 0)
+	for _, id := range ids {
+		if _, ok := owned[id]; !ok {
+			notOwned = append(notOwned, id)
+			continue
+		}
+		tasks = append(tasks, storage.DeleteTask{ID: id, UserID: userID})
 	}
-	go func() {
-		wg.Wait()
-		close(finalCh)
-		u.Log.Debug("Закрыли канал finalCh")
-	}()
 
-	return finalCh
+	if len(notOwned) > 0 {
+		u.Log.Info("Пользователь пытается удалить чужие URL", zap.Int("user", userID), zap.Strings("ids", notOwned))
+	}
+	if len(tasks) == 0 {
+		return notOwned, nil
+	}
+	return notOwned, u.Remover.Enqueue(ctx, tasks)
 }
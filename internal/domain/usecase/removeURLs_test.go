@@ -0,0 +1,122 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Taboon/urlshortner/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type removeRecorder struct {
+	*storage.InternalStorage
+	mu      sync.Mutex
+	removed map[int][]string
+}
+
+func (r *removeRecorder) RemoveURL(ctx context.Context, data []storage.URLData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	userID := ctx.Value(storage.UserID).(int)
+	for _, v := range data {
+		r.removed[userID] = append(r.removed[userID], v.ID)
+	}
+	return nil
+}
+
+func newRemoveRecorder(t *testing.T, file string) *removeRecorder {
+	l := zap.NewNop()
+	is := storage.NewMemoryStorage(l)
+	if file != "" {
+		backuper, err := storage.NewFileStorage(file, l, storage.FileOptions{})
+		require.NoError(t, err)
+		is.Backuper = backuper
+		t.Cleanup(func() { _ = is.Close() })
+	}
+	return &removeRecorder{InternalStorage: is, removed: make(map[int][]string)}
+}
+
+func TestRemoverDrainsOnClose(t *testing.T) {
+	repo := newRemoveRecorder(t, "")
+	rm := NewRemover(repo, zap.NewNop(), RemoverConfig{BatchSize: 100, FlushInterval: time.Hour})
+	require.NoError(t, rm.Start(context.Background()))
+
+	ctx := context.WithValue(context.Background(), storage.UserID, 1)
+	require.NoError(t, rm.Enqueue(ctx, []storage.DeleteTask{{ID: "a", UserID: 1}, {ID: "b", UserID: 1}}))
+	require.NoError(t, rm.Enqueue(ctx, []storage.DeleteTask{{ID: "c", UserID: 2}}))
+
+	require.NoError(t, rm.Close(context.Background()))
+	assert.ElementsMatch(t, []string{"a", "b"}, repo.removed[1])
+	assert.Equal(t, []string{"c"}, repo.removed[2])
+	assert.Error(t, rm.Enqueue(ctx, []storage.DeleteTask{{ID: "d", UserID: 1}}))
+}
+
+func TestRemoverReplaysJournal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+	repo := newRemoveRecorder(t, file)
+	tasks := []storage.DeleteTask{{ID: "a", UserID: 1}, {ID: "b", UserID: 2}}
+	require.NoError(t, repo.AppendDeletes(context.Background(), tasks))
+
+	rm := NewRemover(repo, zap.NewNop(), RemoverConfig{BatchSize: 100, FlushInterval: time.Hour})
+	require.NoError(t, rm.Start(context.Background()))
+	require.NoError(t, rm.Close(context.Background()))
+
+	assert.Equal(t, []string{"a"}, repo.removed[1])
+	assert.Equal(t, []string{"b"}, repo.removed[2])
+
+	pending, err := repo.PendingDeletes(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+type flakyRemover struct {
+	*storage.InternalStorage
+	mu       sync.Mutex
+	fails    int
+	attempts []time.Time
+}
+
+func (r *flakyRemover) RemoveURL(_ context.Context, _ []storage.URLData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts = append(r.attempts, time.Now())
+	if len(r.attempts) <= r.fails {
+		return errors.New("хранилище недоступно")
+	}
+	return nil
+}
+
+func TestRemoverBacksOffFailedBatches(t *testing.T) {
+	repo := &flakyRemover{InternalStorage: storage.NewMemoryStorage(zap.NewNop()), fails: 4}
+	rm := NewRemover(repo, zap.NewNop(), RemoverConfig{
+		BatchSize:        100,
+		FlushInterval:    5 * time.Millisecond,
+		MaxRetryInterval: 20 * time.Millisecond,
+	})
+	require.NoError(t, rm.Start(context.Background()))
+
+	ctx := context.WithValue(context.Background(), storage.UserID, 1)
+	require.NoError(t, rm.Enqueue(ctx, []storage.DeleteTask{{ID: "a", UserID: 1}}))
+
+	require.Eventually(t, func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		return len(repo.attempts) > repo.fails
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, rm.Close(context.Background()))
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	// пауза удваивается от FlushInterval и упирается в MaxRetryInterval
+	want := []time.Duration{5, 10, 20, 20}
+	for i, d := range want {
+		gap := repo.attempts[i+1].Sub(repo.attempts[i])
+		assert.GreaterOrEqual(t, gap, d*time.Millisecond, "повтор %d", i+1)
+	}
+}
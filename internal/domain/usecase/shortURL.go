@@ -2,6 +2,7 @@ package usecase
 
 import (
 	"context"
+	"errors"
 	"go.uber.org/zap"
 	"math/rand"
 	"strings"
@@ -15,6 +16,10 @@ const (
 	httpsPrefix = "https://"
 )
 
+// maxIDAttempts сколько раз сохранение повторяется с новым ID, если сгенерированный
+// ID успели занять между проверкой и записью
+const maxIDAttempts = 3
+
 func (u *URLProcessor) URLValidator(url string) (string, error) {
 	u.Log.Debug("Валидируем URL", zap.String("URL", url))
 
@@ -42,14 +47,26 @@ func (u *URLProcessor) SaveURL(ctx context.Context, url string) (string, error)
 		return data.ID, entity.ErrURLExist
 	}
 
-	id := u.generateID(ctx)
-	urlObj := storage.URLData{URL: url, ID: id}
-
-	if err := u.Repo.AddURL(ctx, urlObj); err != nil {
-		return "", err
+	for attempt := 1; ; attempt++ {
+		id := u.generateID(ctx)
+		urlObj := storage.URLData{URL: url, ID: id}
+
+		// параллельный запрос мог сохранить тот же URL после проверки,
+		// тогда хранилище вернёт ID, сохранённый первым
+		err := u.Repo.AddURL(ctx, urlObj)
+		var exist *storage.URLExistError
+		switch {
+		case err == nil:
+			return id, nil
+		case errors.As(err, &exist):
+			return exist.ID, entity.ErrURLExist
+		case errors.Is(err, entity.ErrIDExist) && attempt < maxIDAttempts:
+			// ID занял параллельный запрос после проверки в generateID
+			u.Log.Debug("ID уже занят, генерируем новый", zap.String("id", id))
+		default:
+			return "", err
+		}
 	}
-
-	return id, nil
 }
 
 func (u *URLProcessor) BatchURLSave(ctx context.Context, b *storage.ReqBatchURLs) (*storage.ReqBatchURLs, error) {
@@ -67,11 +84,52 @@ func (u *URLProcessor) BatchURLSave(ctx context.Context, b *storage.ReqBatchURLs
 		return nil, err
 	}
 
-	b, err = u.Repo.WriteBatchURL(ctx, b)
-	if err != nil {
-		return nil, err
+	for attempt := 1; ; attempt++ {
+		// пачка пишется в транзакции: при занятом ID она откатывается целиком
+		res, err := u.Repo.WriteBatchURL(ctx, b)
+		if errors.Is(err, entity.ErrIDExist) && attempt < maxIDAttempts {
+			u.Log.Debug("ID из пачки уже занят, генерируем новые")
+			for i := range *b {
+				if (*b)[i].Err == nil {
+					(*b)[i].ID = u.generateID(ctx)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return u.retryTakenIDs(ctx, res, attempt)
 	}
+}
+
+// retryTakenIDs повторяет с новыми ID строки, которые хранилище без транзакций
+// отметило entity.ErrIDExist. Уже сохранённые строки повторно не пишутся.
+func (u *URLProcessor) retryTakenIDs(ctx context.Context, b *storage.ReqBatchURLs, attempt int) (*storage.ReqBatchURLs, error) {
+	for ; attempt < maxIDAttempts; attempt++ {
+		var retry storage.ReqBatchURLs
+		var index []int
+		for i, v := range *b {
+			if errors.Is(v.Err, entity.ErrIDExist) {
+				v.Err = nil
+				v.ID = u.generateID(ctx)
+				retry = append(retry, v)
+				index = append(index, i)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+		u.Log.Debug("ID из пачки уже занят, генерируем новые", zap.Int("count", len(retry)))
 
+		res, err := u.Repo.WriteBatchURL(ctx, &retry)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range index {
+			(*b)[i] = (*res)[j]
+		}
+	}
 	return b, nil
 }
 
@@ -0,0 +1,154 @@
+package usecase
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"github.com/Taboon/urlshortner/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// racyRepo не находит URL при проверке, как будто параллельный запрос
+// сохранил его уже после CheckURL
+type racyRepo struct {
+	storage.Store
+}
+
+func (r racyRepo) CheckURL(context.Context, string) (storage.URLData, bool, error) {
+	return storage.URLData{}, false, nil
+}
+
+func TestSaveURLConcurrent(t *testing.T) {
+	for _, scheme := range []string{"memory", "sqlite", "bolt"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx := context.Background()
+			dsn := scheme + "://" + filepath.Join(t.TempDir(), "urls.db")
+			s, err := storage.Open(ctx, dsn, zap.NewNop())
+			require.NoError(t, err)
+			defer s.Close()
+
+			user, err := s.GetNewUser(ctx)
+			require.NoError(t, err)
+			ctx = context.WithValue(ctx, storage.UserID, user)
+			u := URLProcessor{Repo: racyRepo{s}, Log: zap.NewNop()}
+
+			const n = 20
+			ids := make([]string, n)
+			errs := make([]error, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ids[i], errs[i] = u.SaveURL(ctx, "http://ya.ru")
+				}(i)
+			}
+			wg.Wait()
+
+			created := 0
+			for i := 0; i < n; i++ {
+				if errs[i] == nil {
+					created++
+				} else {
+					require.ErrorIs(t, errs[i], entity.ErrURLExist)
+				}
+				assert.Equal(t, ids[0], ids[i], "все запросы получают один ID")
+			}
+			assert.Equal(t, 1, created)
+
+			urls, err := s.GetURLsByUser(ctx, user)
+			require.NoError(t, err)
+			assert.Len(t, urls, 1)
+		})
+	}
+}
+
+// takenIDRepo отвечает, что ID занят, на первые taken записей
+type takenIDRepo struct {
+	storage.Store
+	taken int
+	ids   []string
+}
+
+func (r *takenIDRepo) AddURL(ctx context.Context, data storage.URLData) error {
+	r.ids = append(r.ids, data.ID)
+	if len(r.ids) <= r.taken {
+		return entity.ErrIDExist
+	}
+	return r.Store.AddURL(ctx, data)
+}
+
+func TestSaveURLRetriesTakenID(t *testing.T) {
+	ctx := context.Background()
+	s, err := storage.Open(ctx, "memory://", zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+	user, err := s.GetNewUser(ctx)
+	require.NoError(t, err)
+	ctx = context.WithValue(ctx, storage.UserID, user)
+
+	repo := &takenIDRepo{Store: s, taken: 1}
+	u := URLProcessor{Repo: repo, Log: zap.NewNop()}
+	id, err := u.SaveURL(ctx, "http://ya.ru")
+	require.NoError(t, err)
+	require.Len(t, repo.ids, 2)
+	assert.Equal(t, repo.ids[1], id)
+	assert.NotEqual(t, repo.ids[0], id)
+
+	// ID, занятый раз за разом, не зацикливает запрос
+	repo = &takenIDRepo{Store: s, taken: maxIDAttempts}
+	u.Repo = repo
+	_, err = u.SaveURL(ctx, "http://other.ru")
+	require.ErrorIs(t, err, entity.ErrIDExist)
+	assert.Len(t, repo.ids, maxIDAttempts)
+}
+
+// takenBatchRepo отмечает занятым ID первые taken строк, как хранилище без транзакций
+type takenBatchRepo struct {
+	storage.Store
+	taken int
+	calls int
+}
+
+func (r *takenBatchRepo) WriteBatchURL(ctx context.Context, b *storage.ReqBatchURLs) (*storage.ReqBatchURLs, error) {
+	r.calls++
+	for i := range *b {
+		if (*b)[i].Err == nil && r.taken > 0 {
+			r.taken--
+			(*b)[i].Err = entity.ErrIDExist
+		}
+	}
+	return r.Store.WriteBatchURL(ctx, b)
+}
+
+func TestBatchURLSaveRetriesTakenRows(t *testing.T) {
+	ctx := context.Background()
+	s, err := storage.Open(ctx, "memory://", zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+	user, err := s.GetNewUser(ctx)
+	require.NoError(t, err)
+	ctx = context.WithValue(ctx, storage.UserID, user)
+
+	repo := &takenBatchRepo{Store: s, taken: 1}
+	u := URLProcessor{Repo: repo, Log: zap.NewNop()}
+	res, err := u.BatchURLSave(ctx, &storage.ReqBatchURLs{{URL: "http://a.ru"}, {URL: "http://b.ru"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, repo.calls)
+	for _, v := range *res {
+		assert.NoError(t, v.Err)
+		data, ok, err := s.CheckID(ctx, v.ID)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, v.URL, data.URL)
+	}
+
+	urls, err := s.GetURLsByUser(ctx, user)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2, "сохранённая строка не пишется повторно")
+}
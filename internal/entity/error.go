@@ -6,6 +6,8 @@ var ErrHasNoPrefix = errors.New("has no prefix http:// or https://")
 var ErrHasNoDot = errors.New("has no dot in url")
 
 var ErrURLExist = errors.New("url already exist")
+var ErrIDExist = errors.New("id already exist")
+var ErrURLTooLong = errors.New("url is too long")
 var ErrUnknownUser = errors.New("unknown user")
 
 var ErrUnknownID = errors.New("unknown ID")
@@ -17,3 +19,7 @@ var ErrNoURLToSave = errors.New("no have url to save")
 var ErrJSONInvalid = errors.New("invalid json")
 
 var ErrRepositoryNotInitialized = errors.New("repository not initialized")
+
+var ErrDeleteQueueFull = errors.New("delete queue is full")
+var ErrRemoverClosed = errors.New("remover is closed")
+var ErrStorageClosed = errors.New("storage is closed")
@@ -22,6 +22,11 @@ type RequestJSON struct {
 
 type RequestJSONRemoveURLs []string
 
+// ResponseRemoveURLs перечисляет идентификаторы, которые не были поставлены на удаление
+type ResponseRemoveURLs struct {
+	NotOwned []string `json:"not_owned"`
+}
+
 type Response struct {
 	Result string
 }
@@ -126,15 +131,42 @@ func (s *Server) removeURLs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.P.RemoveURLs(requestBody, r)
+	notOwned, err := s.P.RemoveURLs(r.Context(), requestBody)
+	switch {
+	case errors.Is(err, entity.ErrDeleteQueueFull):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Очередь удаления заполнена", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, entity.ErrUnknownUser):
+		http.Error(w, "Неизвестный пользователь", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Не удалось удалить URL: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	w.WriteHeader(http.StatusAccepted)
+	if len(notOwned) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// сообщаем о чужих идентификаторах; если своих не было совсем, удалять нечего
+	w.Header().Set("Content-Type", "application/json")
+	if len(notOwned) == len(requestBody) {
+		w.WriteHeader(http.StatusForbidden)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	s.writeResponse(w, ResponseRemoveURLs{NotOwned: notOwned})
 }
 
 func (s *Server) setHeader(w http.ResponseWriter, err error) http.ResponseWriter {
 	switch {
 	case errors.Is(err, entity.ErrURLExist):
 		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, entity.ErrURLTooLong):
+		http.Error(w, "URL длиннее допустимого для хранилища: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return w
 	case err != nil && !errors.Is(err, entity.ErrURLExist):
 		http.Error(w, "Не удалось сохранить URL: "+err.Error(), http.StatusBadRequest)
 		return w
@@ -14,15 +14,38 @@ import (
 	"github.com/Taboon/urlshortner/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 )
 
 func initServer() (Server, error) {
+	return initServerWith(func(l *zap.Logger) (storage.Repository, error) {
+		return storage.NewMemoryStorage(l), nil
+	})
+}
+
+// initStoreServer поднимает сервер на хранилище, открытом по DSN
+func initStoreServer(t *testing.T, dsn string) Server {
+	var stor storage.Store
+	s, err := initServerWith(func(l *zap.Logger) (storage.Repository, error) {
+		var err error
+		stor, err = storage.Open(context.Background(), dsn, l)
+		return stor, err
+	})
+	require.NoError(t, err, "Error init server")
+	t.Cleanup(func() {
+		_ = stor.Close()
+	})
+	return s
+}
+
+func initServerWith(newRepo func(l *zap.Logger) (storage.Repository, error)) (Server, error) {
 	// инициализируем конфиг
 	configBuilder := config.NewConfigBuilder()
 	configBuilder.SetLocalAddress("127.0.0.1", 8080)
@@ -36,7 +59,10 @@ func initServer() (Server, error) {
 		return Server{}, err
 	}
 	// инициализируем хранилище
-	stor := storage.NewMemoryStorage(l)
+	stor, err := newRepo(l)
+	if err != nil {
+		return Server{}, err
+	}
 	// инициализируем URL процессор
 	urlProcessor := usecase.URLProcessor{
 		Repo:            stor,
@@ -124,6 +150,12 @@ func TestSendUrl(t *testing.T) {
 }
 
 func Test_getUrl(t *testing.T) {
+	s, err := initServer()
+	require.NoError(t, err, "Error init server")
+	testShortURL(t, s)
+}
+
+func testShortURL(t *testing.T, s Server) {
 
 	tests := []struct {
 		name         string
@@ -138,8 +170,6 @@ func Test_getUrl(t *testing.T) {
 		{name: "test3", method: http.MethodPost, body: "http://ya.ru", contentType: "", expectedCode: http.StatusConflict},
 	}
 
-	s, err := initServer()
-	require.NoError(t, err, "Error init server")
 	cookie, _, err := s.P.Authentificator.SignCookies(context.Background(), nil)
 	require.NoError(t, err, "Error set cookies")
 
@@ -173,6 +203,12 @@ func Test_getUrl(t *testing.T) {
 }
 
 func Test_shortenJSON(t *testing.T) {
+	s, err := initServer()
+	require.NoError(t, err, "Error init server")
+	testShortenJSON(t, s)
+}
+
+func testShortenJSON(t *testing.T, s Server) {
 	tests := []struct {
 		name         string
 		request      string
@@ -186,9 +222,6 @@ func Test_shortenJSON(t *testing.T) {
 		{name: "test4", request: "{\"url\": \"\"}", contentType: "application/json", expectedCode: http.StatusBadRequest},
 	}
 
-	s, err := initServer()
-	require.NoError(t, err, "Error init server")
-
 	server := httptest.NewServer(http.HandlerFunc(s.P.Authentificator.MiddlewareCookies(s.shortenJSON)))
 	defer server.Close()
 
@@ -220,7 +253,35 @@ func Test_shortenJSON(t *testing.T) {
 	}
 }
 
+func Test_shortenJSONURLTooLong(t *testing.T) {
+	s, err := initServerWith(func(l *zap.Logger) (storage.Repository, error) {
+		is := storage.NewMemoryStorage(l)
+		is.MaxURLLength = 20
+		return is, nil
+	})
+	require.NoError(t, err, "Error init server")
+
+	server := httptest.NewServer(http.HandlerFunc(s.P.Authentificator.MiddlewareCookies(s.shortenJSON)))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/shorten", "application/json",
+		strings.NewReader(`{"url": "http://ya.ru/`+strings.Repeat("a", 100)+`"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Contains(t, string(body), "URL длиннее допустимого")
+}
+
 func Test_shortenBatchJSON(t *testing.T) {
+	s, err := initServer()
+	require.NoError(t, err, "Error init server")
+	testShortenBatchJSON(t, s)
+}
+
+func testShortenBatchJSON(t *testing.T, s Server) {
 	regex := regexp.MustCompile(`^(https?|http)://[^\s/$.?#].[^\s]*$`)
 
 	tests := []struct {
@@ -237,8 +298,6 @@ func Test_shortenBatchJSON(t *testing.T) {
 		{name: "test4", request: "[{ \"https://yandex.ru\"}]", contentType: "application/json", expectedCode: http.StatusBadRequest},
 	}
 
-	s, err := initServer()
-	require.NoError(t, err, "Error init server")
 	cookie, _, err := s.P.Authentificator.SignCookies(context.Background(), nil)
 	require.NoError(t, err, "Error set cookies")
 
@@ -343,3 +402,75 @@ func TestGzipCompression(t *testing.T) {
 		//require.JSONEq(t, successBody, string(b))
 	})
 }
+
+func Test_removeURLs(t *testing.T) {
+	s, err := initServer()
+	require.NoError(t, err, "Error init server")
+	testRemoveURLs(t, s)
+}
+
+func testRemoveURLs(t *testing.T, s Server) {
+	s.P.Remover = usecase.NewRemover(s.P.Repo, s.P.Log, usecase.RemoverConfig{})
+	require.NoError(t, s.P.Remover.Start(context.Background()))
+	defer s.P.Remover.Close(context.Background()) //nolint:errcheck
+
+	ownerCookie, ownerID, err := s.P.Authentificator.SignCookies(context.Background(), nil)
+	require.NoError(t, err, "Error set cookies")
+	_, err = AddMock(storage.URLData{URL: "http://ya.ru", ID: "AAAAaaaa"}, &s, ownerID)
+	require.NoError(t, err, "Error add mock")
+
+	otherCookie, otherID, err := s.P.Authentificator.SignCookies(context.Background(), nil)
+	require.NoError(t, err, "Error set cookies")
+	_, err = AddMock(storage.URLData{URL: "http://yandex.ru", ID: "BBBBbbbb"}, &s, otherID)
+	require.NoError(t, err, "Error add mock")
+
+	tests := []struct {
+		name         string
+		cookie       *http.Cookie
+		request      string
+		expectedCode int
+		notOwned     []string
+	}{
+		{name: "own", cookie: ownerCookie, request: `["AAAAaaaa"]`, expectedCode: http.StatusAccepted},
+		{name: "mixed", cookie: ownerCookie, request: `["AAAAaaaa","BBBBbbbb"]`, expectedCode: http.StatusAccepted, notOwned: []string{"BBBBbbbb"}},
+		{name: "foreign", cookie: otherCookie, request: `["AAAAaaaa"]`, expectedCode: http.StatusForbidden, notOwned: []string{"AAAAaaaa"}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(s.P.Authentificator.MiddlewareCookies(s.removeURLs)))
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, server.URL+"/api/user/urls", strings.NewReader(tt.request))
+			require.NoError(t, err)
+			req.AddCookie(tt.cookie)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, resp.StatusCode, "Код ответа не совпадает с ожидаемым")
+			if tt.notOwned != nil {
+				var body ResponseRemoveURLs
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+				assert.Equal(t, tt.notOwned, body.NotOwned)
+			}
+		})
+	}
+}
+
+func TestStoreHandlers(t *testing.T) {
+	stores := map[string]func(dir string) string{
+		"sqlite": func(dir string) string { return "sqlite://" + filepath.Join(dir, "db.sqlite") },
+		"bolt":   func(dir string) string { return "bolt://" + filepath.Join(dir, "db.bolt") },
+		"file":   func(dir string) string { return "file://" + filepath.Join(dir, "db.json") },
+	}
+	for name, dsn := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("shortURL", func(t *testing.T) { testShortURL(t, initStoreServer(t, dsn(t.TempDir()))) })
+			t.Run("shortenJSON", func(t *testing.T) { testShortenJSON(t, initStoreServer(t, dsn(t.TempDir()))) })
+			t.Run("shortenBatchJSON", func(t *testing.T) { testShortenBatchJSON(t, initStoreServer(t, dsn(t.TempDir()))) })
+			t.Run("removeURLs", func(t *testing.T) { testRemoveURLs(t, initStoreServer(t, dsn(t.TempDir()))) })
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Metrics счётчики сервиса для служебного адреса. В отличие от expvar.Handler
+// отдаёт только опубликованные значения: в cmdline бывают DSN с паролями.
+type Metrics struct {
+	mu   sync.RWMutex
+	vars map[string]func() any
+}
+
+// Publish регистрирует функцию, значение которой отдаётся под именем name
+func (m *Metrics) Publish(name string, value func() any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vars == nil {
+		m.vars = make(map[string]func() any)
+	}
+	m.vars[name] = value
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.vars))
+	for name := range m.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make(map[string]any, len(names))
+	for _, name := range names {
+		values[name] = m.vars[name]()
+	}
+	m.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// RunMetrics отдаёт метрики на отдельном адресе по /debug/vars и останавливается после отмены ctx.
+// Адрес не должен быть доступен снаружи.
+func RunMetrics(ctx context.Context, addr string, m *Metrics, l *zap.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", m)
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(c); err != nil {
+			l.Error("Ошибка остановки сервера метрик", zap.Error(err))
+		}
+	}()
+
+	l.Info("Отдаём метрики", zap.String("address", addr))
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
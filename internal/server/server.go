@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
@@ -20,7 +22,9 @@ type Server struct {
 	Log          *logger.Logger
 }
 
-func (s *Server) Run(la config.Address) error {
+// Run запускает сервер и плавно останавливает его после отмены ctx.
+// Возвращается, когда начатые запросы завершены, или с ошибкой Shutdown.
+func (s *Server) Run(ctx context.Context, la config.Address) error {
 	srv := &http.Server{
 		Addr:         la.String(),
 		Handler:      s.URLRouter(),
@@ -29,13 +33,29 @@ func (s *Server) Run(la config.Address) error {
 		IdleTimeout:  15 * time.Second,
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("HTTP server error: %v", err)
-		}
-		return err
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("HTTP server error: %v", err)
 	}
-	return nil
+	return s.serve(ctx, srv, ln, 10*time.Second)
+}
+
+// serve обслуживает запросы до отмены ctx. Serve возвращается сразу после вызова
+// Shutdown, поэтому ждём сам Shutdown: он дожидается начатых запросов или timeout.
+func (s *Server) serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		s.Log.Info("Останавливаем сервер")
+		c, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- srv.Shutdown(c)
+	}()
+
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("HTTP server error: %v", err)
+	}
+	return <-done
 }
 
 func (s *Server) URLRouter() chi.Router {
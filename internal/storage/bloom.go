@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"context"
+	"hash/maphash"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// bloomRebuildBatch размер страницы при чтении ID из хранилища
+const bloomRebuildBatch = 10000
+
+// BloomOptions настройки фильтра коротких ссылок
+type BloomOptions struct {
+	// ExpectedItems на сколько ссылок рассчитан фильтр. При перестроении
+	// берётся не меньше удвоенного количества ссылок в хранилище.
+	ExpectedItems int
+	// FPRate желаемая доля ложноположительных ответов
+	FPRate float64
+}
+
+// FilterStats счётчики фильтра
+type FilterStats struct {
+	Ready    bool   `json:"ready"`
+	Items    uint64 `json:"items"`
+	Capacity uint64 `json:"capacity"`
+	Checks   uint64 `json:"checks"`
+	// Negatives запросы, отвеченные фильтром без обращения к хранилищу
+	Negatives uint64 `json:"negatives"`
+	// FalsePositives фильтр пропустил запрос, а ссылки в хранилище не оказалось
+	FalsePositives uint64 `json:"false_positives"`
+	// FalsePositiveRate доля отсутствующих ссылок, которые фильтр не отсеял
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+	// EstimatedFPRate теоретическая доля ложноположительных при текущем заполнении
+	EstimatedFPRate float64 `json:"estimated_fp_rate"`
+}
+
+// bloomFilter фильтр Блума с атомарными операциями над битами
+type bloomFilter struct {
+	bits     []atomic.Uint64
+	m        uint64
+	k        uint64
+	capacity uint64
+	items    atomic.Uint64
+	seed     maphash.Seed
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{
+		bits:     make([]atomic.Uint64, m/64),
+		m:        m,
+		k:        k,
+		capacity: uint64(n),
+		seed:     maphash.MakeSeed(),
+	}
+}
+
+// locations двойное хеширование: i-й бит равен h1 + i*h2
+func (b *bloomFilter) locations(id string) (uint64, uint64) {
+	h := maphash.String(b.seed, id)
+	return h, h>>32 | h<<32 | 1
+}
+
+// Add считает ID новым, только если выставил хотя бы один бит: повторное
+// добавление, например по собственному уведомлению, не раздувает счётчик
+func (b *bloomFilter) Add(id string) {
+	h1, h2 := b.locations(id)
+	added := false
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		word, mask := &b.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := word.Load()
+			if old&mask != 0 {
+				break
+			}
+			if word.CompareAndSwap(old, old|mask) {
+				added = true
+				break
+			}
+		}
+	}
+	if added {
+		b.items.Add(1)
+	}
+}
+
+func (b *bloomFilter) MayContain(id string) bool {
+	h1, h2 := b.locations(id)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64].Load()&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) estimatedFPRate() float64 {
+	n := float64(b.items.Load())
+	return math.Pow(1-math.Exp(-float64(b.k)*n/float64(b.m)), float64(b.k))
+}
+
+// FilteredRepository отвечает «ссылки точно нет» по фильтру Блума, не обращаясь к хранилищу.
+// Это ускоряет подбор свободного ID и отсекает перебор случайных ссылок.
+// Пока фильтр строится, все запросы идут в хранилище.
+type FilteredRepository struct {
+	Store
+	log  *zap.Logger
+	opts BloomOptions
+
+	filter atomic.Pointer[bloomFilter]
+	ready  atomic.Bool
+
+	// building фильтр, который сейчас заполняется из хранилища. Новые ID пишутся в оба.
+	mu         sync.Mutex
+	building   *bloomFilter
+	rebuilding bool
+	// writes запись держит на чтение от добавления ID в фильтр до записи в хранилище.
+	// Перестроение ставит building под Lock: начатые записи к этому времени уже
+	// в хранилище и попадут в обход, а следующие запишут ID и в building.
+	writes sync.RWMutex
+	wg     sync.WaitGroup
+	// ctx фоновых перестроений, отменяется в Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	checks         atomic.Uint64
+	negatives      atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+var _ Store = (*FilteredRepository)(nil)
+var _ DeleteJournal = (*FilteredRepository)(nil)
+
+func NewFilteredRepository(s Store, l *zap.Logger, opts BloomOptions) *FilteredRepository {
+	f := &FilteredRepository{Store: s, log: l, opts: opts}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.filter.Store(newBloomFilter(opts.ExpectedItems, opts.FPRate))
+	return f
+}
+
+func (f *FilteredRepository) CheckID(ctx context.Context, id string) (URLData, bool, error) {
+	f.checks.Add(1)
+	if f.ready.Load() && !f.filter.Load().MayContain(id) {
+		f.negatives.Add(1)
+		return URLData{}, false, nil
+	}
+
+	// CheckID хранилища не зависит от пользователя: промах после фильтра и есть ложноположительный ответ
+	data, ok, err := f.Store.CheckID(ctx, id)
+	if err == nil && !ok && f.ready.Load() {
+		f.falsePositives.Add(1)
+	}
+	return data, ok, err
+}
+
+// add добавляет ID в фильтр до записи в хранилище: ссылка не должна
+// оказаться в хранилище раньше, чем в фильтре
+func (f *FilteredRepository) add(ids ...string) {
+	f.mu.Lock()
+	filter, building := f.filter.Load(), f.building
+	f.mu.Unlock()
+
+	for _, id := range ids {
+		filter.Add(id)
+		if building != nil {
+			building.Add(id)
+		}
+	}
+	// фильтр переполнен и врёт чаще заданного, пересобираем его большего размера
+	if filter.items.Load() > 2*filter.capacity {
+		f.Start()
+	}
+}
+
+func (f *FilteredRepository) AddURL(ctx context.Context, data URLData) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+	f.add(data.ID)
+	return f.Store.AddURL(ctx, data)
+}
+
+func (f *FilteredRepository) WriteBatchURL(ctx context.Context, b *ReqBatchURLs) (*ReqBatchURLs, error) {
+	ids := make([]string, 0, len(*b))
+	for _, v := range *b {
+		if v.Err == nil {
+			ids = append(ids, v.ID)
+		}
+	}
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+	f.add(ids...)
+	return f.Store.WriteBatchURL(ctx, b)
+}
+
+// Apply учитывает ссылки, добавленные другими экземплярами сервиса.
+// Удалённые ссылки остаются в хранилище, поэтому из фильтра не убираются.
+func (f *FilteredRepository) Apply(ev ChangeEvent) {
+	switch ev.Op {
+	case ChangeUpdated:
+		f.add(ev.IDs...)
+	case ChangePurge:
+		// часть уведомлений потеряна, до перестроения фильтру верить нельзя
+		f.ready.Store(false)
+		f.Start()
+	}
+}
+
+// Start перестраивает фильтр в фоне, если перестроение ещё не идёт
+func (f *FilteredRepository) Start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rebuilding {
+		return
+	}
+	f.rebuilding = true
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		if err := f.Rebuild(f.ctx); err != nil {
+			f.log.Error("Ошибка построения фильтра ссылок", zap.Error(err))
+		}
+	}()
+}
+
+// Rebuild заполняет новый фильтр всеми ID из хранилища и подменяет им текущий.
+// Хранилище без экспорта фильтровать нельзя, тогда запросы всегда идут в него.
+func (f *FilteredRepository) Rebuild(ctx context.Context) error {
+	defer func() {
+		f.mu.Lock()
+		f.building = nil
+		f.rebuilding = false
+		f.mu.Unlock()
+	}()
+
+	exporter, ok := f.Store.(Exporter)
+	if !ok {
+		f.log.Info("Хранилище не поддерживает экспорт, фильтр ссылок отключён")
+		return nil
+	}
+	stats, err := exporter.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := newBloomFilter(max(f.opts.ExpectedItems, 2*stats.URLs), f.opts.FPRate)
+	// до обхода: иначе ID, записанный только в старый фильтр, появится
+	// в хранилище позади курсора и новый фильтр его не узнает
+	f.writes.Lock()
+	f.mu.Lock()
+	f.rebuilding = true
+	f.building = filter
+	f.mu.Unlock()
+	f.writes.Unlock()
+
+	after := ""
+	for {
+		records, err := exporter.ExportURLs(ctx, after, bloomRebuildBatch)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, r := range records {
+			filter.Add(r.ID)
+		}
+		after = records[len(records)-1].ID
+	}
+
+	f.mu.Lock()
+	f.filter.Store(filter)
+	f.mu.Unlock()
+	f.ready.Store(true)
+	f.log.Info("Построили фильтр ссылок", zap.Uint64("items", filter.items.Load()),
+		zap.Uint64("capacity", filter.capacity), zap.Uint64("bits", filter.m), zap.Uint64("hashes", filter.k))
+	return nil
+}
+
+func (f *FilteredRepository) FilterStats() FilterStats {
+	filter := f.filter.Load()
+	stats := FilterStats{
+		Ready:           f.ready.Load(),
+		Items:           filter.items.Load(),
+		Capacity:        filter.capacity,
+		Checks:          f.checks.Load(),
+		Negatives:       f.negatives.Load(),
+		FalsePositives:  f.falsePositives.Load(),
+		EstimatedFPRate: filter.estimatedFPRate(),
+	}
+	if absent := stats.Negatives + stats.FalsePositives; absent > 0 {
+		stats.FalsePositiveRate = float64(stats.FalsePositives) / float64(absent)
+	}
+	return stats
+}
+
+// Журнал удалений пробрасывается в хранилище, если оно его поддерживает
+
+func (f *FilteredRepository) AppendDeletes(ctx context.Context, tasks []DeleteTask) error {
+	if j, ok := f.Store.(DeleteJournal); ok {
+		return j.AppendDeletes(ctx, tasks)
+	}
+	return nil
+}
+
+func (f *FilteredRepository) AckDeletes(ctx context.Context, tasks []DeleteTask) error {
+	if j, ok := f.Store.(DeleteJournal); ok {
+		return j.AckDeletes(ctx, tasks)
+	}
+	return nil
+}
+
+func (f *FilteredRepository) PendingDeletes(ctx context.Context) ([]DeleteTask, error) {
+	if j, ok := f.Store.(DeleteJournal); ok {
+		return j.PendingDeletes(ctx)
+	}
+	return nil, nil
+}
+
+// Close прерывает перестроение фильтра и закрывает хранилище
+func (f *FilteredRepository) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	stats := f.FilterStats()
+	f.log.Info("Статистика фильтра ссылок",
+		zap.Uint64("checks", stats.Checks), zap.Uint64("negatives", stats.Negatives),
+		zap.Uint64("false_positives", stats.FalsePositives), zap.Float64("false_positive_rate", stats.FalsePositiveRate))
+	return f.Store.Close()
+}
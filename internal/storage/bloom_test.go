@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	b := newBloomFilter(n, 0.01)
+	for i := 0; i < n; i++ {
+		b.Add(fmt.Sprintf("in%06d", i))
+	}
+	for i := 0; i < n; i++ {
+		require.True(t, b.MayContain(fmt.Sprintf("in%06d", i)), "ложноотрицательных ответов не бывает")
+	}
+
+	fp := 0
+	for i := 0; i < n; i++ {
+		if b.MayContain(fmt.Sprintf("out%06d", i)) {
+			fp++
+		}
+	}
+	assert.Less(t, float64(fp)/n, 0.02)
+	assert.InDelta(t, 0.01, b.estimatedFPRate(), 0.005)
+
+	// счётчик не учитывает ID, все биты которых уже выставлены
+	items := b.items.Load()
+	assert.InDelta(t, n, items, n*0.01)
+	b.Add("in000000")
+	assert.Equal(t, items, b.items.Load())
+}
+
+func TestFilteredRepository(t *testing.T) {
+	ctx := context.Background()
+	dsn := "bolt://" + filepath.Join(t.TempDir(), "urls.db")
+	s, err := Open(ctx, dsn, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, s.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+
+	f := NewFilteredRepository(s, zap.NewNop(), BloomOptions{ExpectedItems: 100, FPRate: 0.01})
+	defer f.Close()
+
+	// пока фильтр не построен, ответы идут из хранилища
+	_, ok, err := f.CheckID(ctx, "BBBBbbbb")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), f.FilterStats().Negatives)
+
+	require.NoError(t, f.Rebuild(ctx))
+	stats := f.FilterStats()
+	assert.True(t, stats.Ready)
+	assert.Equal(t, uint64(1), stats.Items)
+
+	data, ok, err := f.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "http://ya.ru", data.URL)
+
+	for i := 0; i < 100; i++ {
+		_, ok, err := f.CheckID(ctx, fmt.Sprintf("none%04d", i))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	}
+	stats = f.FilterStats()
+	assert.Equal(t, uint64(100), stats.Negatives+stats.FalsePositives)
+	assert.Greater(t, stats.Negatives, uint64(90))
+
+	// подбор ID идёт от имени пользователя, чужая ссылка не считается ложноположительным ответом
+	_, ok, err = f.CheckID(userContext(2), "AAAAaaaa")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, stats.FalsePositives, f.FilterStats().FalsePositives)
+
+	// новые ссылки попадают в фильтр при записи
+	require.NoError(t, f.AddURL(userContext(1), URLData{ID: "CCCCcccc", URL: "http://c.ru"}))
+	batch := ReqBatchURLs{{ID: "DDDDdddd", URL: "http://d.ru"}}
+	_, err = f.WriteBatchURL(userContext(1), &batch)
+	require.NoError(t, err)
+	for _, id := range []string{"CCCCcccc", "DDDDdddd"} {
+		_, ok, err := f.CheckID(ctx, id)
+		require.NoError(t, err)
+		assert.True(t, ok, id)
+	}
+
+	// и при уведомлении от другого экземпляра
+	f.Apply(ChangeEvent{Op: ChangeUpdated, IDs: []string{"EEEEeeee"}})
+	assert.True(t, f.filter.Load().MayContain("EEEEeeee"))
+
+	// после потери уведомлений фильтр не используется, пока не перестроится
+	f.Apply(ChangeEvent{Op: ChangePurge})
+	f.wg.Wait()
+	stats = f.FilterStats()
+	assert.True(t, stats.Ready)
+	assert.Equal(t, uint64(3), stats.Items)
+}
+
+// slowAddStore задерживает запись ссылки в хранилище после того, как она попала в фильтр
+type slowAddStore struct {
+	exportStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *slowAddStore) AddURL(ctx context.Context, data URLData) error {
+	close(s.entered)
+	<-s.release
+	return s.exportStore.AddURL(ctx, data)
+}
+
+type exportStore interface {
+	Store
+	Exporter
+}
+
+func TestFilteredRepositoryRebuildDuringWrite(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, "bolt://"+filepath.Join(t.TempDir(), "urls.db"), zap.NewNop())
+	require.NoError(t, err)
+	slow := &slowAddStore{exportStore: s.(exportStore), entered: make(chan struct{}), release: make(chan struct{})}
+	f := NewFilteredRepository(slow, zap.NewNop(), BloomOptions{ExpectedItems: 100, FPRate: 0.01})
+	defer f.Close()
+	require.NoError(t, f.Rebuild(ctx))
+
+	added := make(chan error, 1)
+	go func() {
+		added <- f.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"})
+	}()
+	<-slow.entered
+
+	// перестроение начинается, пока ссылка есть в старом фильтре, но ещё не в хранилище
+	rebuilt := make(chan error, 1)
+	go func() {
+		rebuilt <- f.Rebuild(ctx)
+	}()
+	select {
+	case err := <-rebuilt:
+		t.Fatalf("перестроение не дождалось начатой записи: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.release)
+	require.NoError(t, <-added)
+	require.NoError(t, <-rebuilt)
+
+	_, ok, err := f.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	assert.True(t, ok, "новый фильтр не должен терять записанную ссылку")
+}
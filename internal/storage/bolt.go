@@ -0,0 +1,489 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	// boltURLs ID ссылки → запись boltURL
+	boltURLs = []byte("urls")
+	// boltURLIndex SHA-256 URL → ID первой сокращённой ссылки, для поиска без пользователя.
+	// Ключ bolt ограничен 32 КБ, поэтому URL в ключах заменён хешем.
+	boltURLIndex = []byte("url_hash_index")
+	// boltUserURLs ID пользователя (8 байт) + SHA-256 URL → ID ссылки
+	boltUserURLs = []byte("user_url_hashes")
+	// boltLegacyIndexes индексы по самому URL из прежних версий, перестраиваются при открытии
+	boltLegacyIndexes = [][]byte{[]byte("url_index"), []byte("user_urls")}
+	// boltUsers счётчик пользователей хранится в последовательности бакета
+	boltUsers = []byte("users")
+	// boltDeleteQueue журнал удалений: ID пользователя (8 байт) + ID ссылки
+	boltDeleteQueue = []byte("delete_queue")
+)
+
+type Bolt struct {
+	db  *bolt.DB
+	Log *zap.Logger
+}
+
+var _ Store = (*Bolt)(nil)
+var _ DeleteJournal = (*Bolt)(nil)
+var _ Exporter = (*Bolt)(nil)
+var _ Importer = (*Bolt)(nil)
+
+func init() {
+	Register("bolt", func(_ context.Context, dsn string, _ Options, l *zap.Logger) (Store, error) {
+		return SetBolt(dsn, l)
+	})
+}
+
+type boltURL struct {
+	URL     string `json:"url"`
+	UserID  int    `json:"user_id"`
+	Deleted bool   `json:"is_deleted,omitempty"`
+}
+
+// SetBolt открывает файл базы по DSN вида bolt:///var/lib/shortener.bolt и создаёт бакеты
+func SetBolt(dsn string, l *zap.Logger) (*Bolt, error) {
+	path, _, err := dsnPath(dsn, "bolt")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0774); err != nil {
+		return nil, err
+	}
+
+	// файл блокируется на время работы, второй процесс дождётся таймаута и получит ошибку
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltURLs, boltURLIndex, boltUserURLs, boltUsers, boltDeleteQueue} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return migrateBoltIndexes(tx)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db, Log: l}, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *Bolt) Ping(_ context.Context) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLs) == nil {
+			return entity.ErrRepositoryNotInitialized
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) AddURL(ctx context.Context, urlData URLData) error {
+	b.Log.Debug("Добавляем URL в bolt", zap.String("url", urlData.URL))
+	userID, _ := ctx.Value(UserID).(int)
+
+	// транзакции записи bolt выполняются по одной, проверка и запись не разделены гонкой
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if id := tx.Bucket(boltUserURLs).Get(boltUserURLKey(userID, urlData.URL)); id != nil {
+			return &URLExistError{ID: string(id)}
+		}
+		return putBoltURL(tx, urlData.ID, boltURL{URL: urlData.URL, UserID: userID})
+	})
+}
+
+// WriteBatchURL записывает все валидные ссылки пачки в одной транзакции.
+// Занятый ID откатывает всю пачку с entity.ErrIDExist.
+func (b *Bolt) WriteBatchURL(ctx context.Context, batch *ReqBatchURLs) (*ReqBatchURLs, error) {
+	userID, _ := ctx.Value(UserID).(int)
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for i, v := range *batch {
+			// если данные не валидны, пропускаем текущую итерацию
+			if v.Err != nil {
+				continue
+			}
+			if id := tx.Bucket(boltUserURLs).Get(boltUserURLKey(userID, v.URL)); id != nil {
+				(*batch)[i].Err = entity.ErrURLExist
+				(*batch)[i].ID = string(id)
+				continue
+			}
+			if err := putBoltURL(tx, v.ID, boltURL{URL: v.URL, UserID: userID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func putBoltURL(tx *bolt.Tx, id string, data boltURL) error {
+	urls := tx.Bucket(boltURLs)
+	if urls.Get([]byte(id)) != nil {
+		return fmt.Errorf("%w: %s", entity.ErrIDExist, id)
+	}
+
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := urls.Put([]byte(id), value); err != nil {
+		return err
+	}
+
+	return putBoltIndexes(tx, id, data)
+}
+
+func putBoltIndexes(tx *bolt.Tx, id string, data boltURL) error {
+	index := tx.Bucket(boltURLIndex)
+	hash := boltURLHash(data.URL)
+	if index.Get(hash) == nil {
+		if err := index.Put(hash, []byte(id)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltUserURLs).Put(boltUserURLKey(data.UserID, data.URL), []byte(id))
+}
+
+// migrateBoltIndexes заменяет индексы по URL индексами по хешу
+func migrateBoltIndexes(tx *bolt.Tx) error {
+	legacy := false
+	for _, name := range boltLegacyIndexes {
+		if tx.Bucket(name) != nil {
+			legacy = true
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+	if !legacy {
+		return nil
+	}
+
+	return tx.Bucket(boltURLs).ForEach(func(k, v []byte) error {
+		var rec boltURL
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		return putBoltIndexes(tx, string(k), rec)
+	})
+}
+
+func (b *Bolt) CheckID(_ context.Context, id string) (URLData, bool, error) {
+	var data URLData
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		rec, found, err := getBoltURL(tx, id)
+		if err != nil || !found {
+			return err
+		}
+		data = URLData{ID: id, URL: rec.URL, Deleted: rec.Deleted}
+		ok = true
+		return nil
+	})
+	return data, ok, err
+}
+
+func (b *Bolt) CheckURL(ctx context.Context, u string) (URLData, bool, error) {
+	userID, _ := ctx.Value(UserID).(int)
+
+	var data URLData
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		data, ok, err = lookupBoltURL(tx, userID, u)
+		return err
+	})
+	return data, ok, err
+}
+
+func lookupBoltURL(tx *bolt.Tx, userID int, u string) (URLData, bool, error) {
+	var id []byte
+	if userID == 0 {
+		id = tx.Bucket(boltURLIndex).Get(boltURLHash(u))
+	} else {
+		id = tx.Bucket(boltUserURLs).Get(boltUserURLKey(userID, u))
+	}
+	if id == nil {
+		return URLData{}, false, nil
+	}
+
+	rec, found, err := getBoltURL(tx, string(id))
+	if err != nil || !found || rec.URL != u {
+		return URLData{}, false, err
+	}
+	return URLData{ID: string(id), URL: rec.URL, Deleted: rec.Deleted}, true, nil
+}
+
+func getBoltURL(tx *bolt.Tx, id string) (boltURL, bool, error) {
+	var rec boltURL
+	value := tx.Bucket(boltURLs).Get([]byte(id))
+	if value == nil {
+		return rec, false, nil
+	}
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return rec, false, err
+	}
+	return rec, true, nil
+}
+
+func (b *Bolt) CheckBatchURL(ctx context.Context, urls *ReqBatchURLs) (*ReqBatchURLs, error) {
+	userID, _ := ctx.Value(UserID).(int)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for i, v := range *urls {
+			if v.Err != nil {
+				continue
+			}
+			data, ok, err := lookupBoltURL(tx, userID, v.URL)
+			if err != nil {
+				return err
+			}
+			if ok {
+				(*urls)[i].Err = entity.ErrURLExist
+				(*urls)[i].ID = data.ID
+				(*urls)[i].Deleted = data.Deleted
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (b *Bolt) RemoveURL(ctx context.Context, data []URLData) error {
+	userID, ok := ctx.Value(UserID).(int)
+	if !ok || userID == 0 {
+		return entity.ErrUnknownUser
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		urls := tx.Bucket(boltURLs)
+		for _, v := range data {
+			rec, found, err := getBoltURL(tx, v.ID)
+			if err != nil {
+				return err
+			}
+			// удаляем только ссылки, принадлежащие пользователю из контекста
+			if !found || rec.UserID != userID || rec.Deleted {
+				continue
+			}
+			rec.Deleted = true
+			value, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := urls.Put([]byte(v.ID), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) GetNewUser(_ context.Context) (int, error) {
+	var id uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		id, err = tx.Bucket(boltUsers).NextSequence()
+		return err
+	})
+	return int(id), err
+}
+
+func (b *Bolt) GetURLsByUser(_ context.Context, id int) (UserURLs, error) {
+	urls := UserURLs{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := boltUserKey(id, "")
+		c := tx.Bucket(boltUserURLs).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rec, found, err := getBoltURL(tx, string(v))
+			if err != nil {
+				return err
+			}
+			if found {
+				urls = append(urls, URLData{ID: string(v), URL: rec.URL, Deleted: rec.Deleted})
+			}
+		}
+		return nil
+	})
+	return urls, err
+}
+
+func (b *Bolt) OwnedIDs(_ context.Context, userID int, ids []string) ([]string, error) {
+	owned := make([]string, 0, len(ids))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			rec, found, err := getBoltURL(tx, id)
+			if err != nil {
+				return err
+			}
+			if found && rec.UserID == userID {
+				owned = append(owned, id)
+			}
+		}
+		return nil
+	})
+	return owned, err
+}
+
+func (b *Bolt) AppendDeletes(_ context.Context, tasks []DeleteTask) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltDeleteQueue)
+		for _, t := range tasks {
+			if err := queue.Put(boltUserKey(t.UserID, t.ID), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) AckDeletes(_ context.Context, tasks []DeleteTask) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltDeleteQueue)
+		for _, t := range tasks {
+			if err := queue.Delete(boltUserKey(t.UserID, t.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) PendingDeletes(_ context.Context) ([]DeleteTask, error) {
+	var tasks []DeleteTask
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeleteQueue).ForEach(func(k, _ []byte) error {
+			userID, id := splitBoltUserKey(k)
+			tasks = append(tasks, DeleteTask{ID: id, UserID: userID})
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+// boltUserKey ключ вида ID пользователя + строка. ID в big endian,
+// чтобы ключи одного пользователя шли подряд и находились по префиксу.
+func boltUserKey(userID int, s string) []byte {
+	key := make([]byte, 8, 8+len(s))
+	binary.BigEndian.PutUint64(key, uint64(userID))
+	return append(key, s...)
+}
+
+// boltURLHash ключ индекса по URL
+func boltURLHash(u string) []byte {
+	h := sha256.Sum256([]byte(u))
+	return h[:]
+}
+
+func boltUserURLKey(userID int, u string) []byte {
+	return boltUserKey(userID, string(boltURLHash(u)))
+}
+
+func splitBoltUserKey(key []byte) (int, string) {
+	return int(binary.BigEndian.Uint64(key[:8])), string(key[8:])
+}
+
+func (b *Bolt) Stats(_ context.Context) (Stats, error) {
+	var stats Stats
+	err := b.db.View(func(tx *bolt.Tx) error {
+		stats.LastUserID = int(tx.Bucket(boltUsers).Sequence())
+		return tx.Bucket(boltURLs).ForEach(func(_, v []byte) error {
+			var rec boltURL
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			stats.URLs++
+			if rec.Deleted {
+				stats.Deleted++
+			}
+			return nil
+		})
+	})
+	return stats, err
+}
+
+func (b *Bolt) ExportURLs(_ context.Context, after string, limit int) ([]Record, error) {
+	var records []Record
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltURLs).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(records) < limit; k, v = c.Next() {
+			var rec boltURL
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			records = append(records, Record{ID: string(k), URL: rec.URL, UserID: rec.UserID, Deleted: rec.Deleted})
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (b *Bolt) ImportUsers(_ context.Context, lastUserID int) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsers)
+		if uint64(lastUserID) <= users.Sequence() {
+			return nil
+		}
+		return users.SetSequence(uint64(lastUserID))
+	})
+}
+
+func (b *Bolt) ImportURLs(_ context.Context, records []Record) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range records {
+			rec, found, err := getBoltURL(tx, r.ID)
+			if err != nil {
+				return err
+			}
+			if !found {
+				err = putBoltURL(tx, r.ID, boltURL{URL: r.URL, UserID: r.UserID, Deleted: r.Deleted})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if rec.Deleted == r.Deleted {
+				continue
+			}
+			rec.Deleted = r.Deleted
+			value, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltURLs).Put([]byte(r.ID), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+func TestBoltReopen(t *testing.T) {
+	dsn := "bolt://" + filepath.Join(t.TempDir(), "db.bolt")
+	b, err := SetBolt(dsn, zap.NewNop())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user, err := b.GetNewUser(ctx)
+	require.NoError(t, err)
+	userCtx := userContext(user)
+
+	batch := ReqBatchURLs{
+		{ID: "AAAAaaaa", URL: "http://ya.ru"},
+		{ID: "BBBBbbbb", URL: "http://yandex.ru"},
+		{ID: "CCCCcccc", URL: "http://bad", Err: entity.ErrHasNoDot},
+	}
+	_, err = b.WriteBatchURL(userCtx, &batch)
+	require.NoError(t, err)
+	require.NoError(t, b.RemoveURL(userCtx, []URLData{{ID: "BBBBbbbb"}}))
+	require.NoError(t, b.Close())
+
+	b, err = SetBolt(dsn, zap.NewNop())
+	require.NoError(t, err)
+	defer b.Close()
+
+	next, err := b.GetNewUser(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, user+1, next)
+
+	data, ok, err := b.CheckURL(ctx, "http://ya.ru")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "AAAAaaaa", data.ID)
+
+	_, ok, err = b.CheckURL(userContext(next), "http://ya.ru")
+	require.NoError(t, err)
+	assert.False(t, ok, "чужая ссылка не должна находиться по URL")
+
+	_, ok, err = b.CheckID(ctx, "CCCCcccc")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	urls, err := b.GetURLsByUser(ctx, user)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, UserURLs{
+		{ID: "AAAAaaaa", URL: "http://ya.ru"},
+		{ID: "BBBBbbbb", URL: "http://yandex.ru", Deleted: true},
+	}, urls)
+}
+
+func TestBoltMigratesURLIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.bolt")
+
+	// файл прежней версии: индексы по самому URL
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		urls, err := tx.CreateBucket(boltURLs)
+		if err != nil {
+			return err
+		}
+		if err := urls.Put([]byte("AAAAaaaa"), []byte(`{"url":"http://ya.ru","user_id":1}`)); err != nil {
+			return err
+		}
+		index, err := tx.CreateBucket([]byte("url_index"))
+		if err != nil {
+			return err
+		}
+		return index.Put([]byte("http://ya.ru"), []byte("AAAAaaaa"))
+	}))
+	require.NoError(t, db.Close())
+
+	b, err := SetBolt("bolt://"+path, zap.NewNop())
+	require.NoError(t, err)
+	defer b.Close()
+
+	for _, ctx := range []context.Context{context.Background(), userContext(1)} {
+		data, ok, err := b.CheckURL(ctx, "http://ya.ru")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "AAAAaaaa", data.ID)
+	}
+	require.NoError(t, b.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte("url_index")))
+		return nil
+	}))
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CacheOptions настройки кеша коротких ссылок
+type CacheOptions struct {
+	// Size максимальное количество ссылок в кеше
+	Size int
+	// TTL сколько найденная ссылка живёт в кеше. 0 — до вытеснения.
+	TTL time.Duration
+	// NegativeTTL сколько кешируется отсутствие ссылки. 0 отключает кеширование промахов.
+	NegativeTTL time.Duration
+	// Shared общий для всех экземпляров кеш, к которому обращаемся при локальном промахе
+	Shared SharedCache
+}
+
+// SharedCache внешний кеш, общий для экземпляров сервиса. Его ошибки не ломают
+// редиректы: при недоступности кеша ссылка читается из хранилища.
+type SharedCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// SetMany сохраняет одно значение под всеми ключами. ttl 0 — без срока жизни.
+	SetMany(ctx context.Context, keys []string, value []byte, ttl time.Duration) error
+	// Add сохраняет значение, только если ключа нет, и сообщает, сохранено ли оно
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// sharedKeyPrefix отделяет ключи сервиса от чужих ключей в общем кеше
+const sharedKeyPrefix = "urlshortner:url:"
+
+// sharedTombstoneTTL сколько живёт отметка об изменении ссылки в общем кеше.
+// Должно быть дольше чтения из хранилища: ответ, прочитанный до изменения,
+// не попадёт в общий кеш, пока отметка жива. Пока отметка жива, ссылка
+// читается из хранилища.
+const sharedTombstoneTTL = 10 * time.Second
+
+// sharedEntry значение ссылки в общем кеше
+type sharedEntry struct {
+	URL     string `json:"url,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Found   bool   `json:"found"`
+	// Tombstone ссылка недавно изменилась, значение нужно читать из хранилища
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// CacheStats счётчики кеша
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+	// SharedHits локальные промахи, найденные в общем кеше
+	SharedHits uint64 `json:"shared_hits"`
+	// SharedErrors ошибки общего кеша, включая запросы при разомкнутом автомате
+	SharedErrors uint64 `json:"shared_errors"`
+}
+
+// CachedRepository кеширует поиск ссылки по ID для редиректов поверх любого хранилища.
+// Кешируются только запросы без пользователя в контексте: поиск с пользователем
+// ограничен его ссылками и идёт напрямую в хранилище.
+type CachedRepository struct {
+	Store
+	log  *zap.Logger
+	opts CacheOptions
+
+	mu    sync.Mutex
+	ll    *list.List // от недавно использованных к давно
+	items map[string]*list.Element
+	// gen увеличивается при каждой инвалидации. Промах кладёт ответ хранилища в кеш,
+	// только если за время запроса инвалидаций не было, иначе ответ мог устареть.
+	gen uint64
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	evictions    atomic.Uint64
+	sharedHits   atomic.Uint64
+	sharedErrors atomic.Uint64
+}
+
+var _ Store = (*CachedRepository)(nil)
+var _ DeleteJournal = (*CachedRepository)(nil)
+
+type cacheEntry struct {
+	id      string
+	data    URLData
+	found   bool
+	expires time.Time
+}
+
+func NewCachedRepository(s Store, l *zap.Logger, opts CacheOptions) *CachedRepository {
+	return &CachedRepository{
+		Store: s,
+		log:   l,
+		opts:  opts,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, opts.Size),
+	}
+}
+
+func (c *CachedRepository) CheckID(ctx context.Context, id string) (URLData, bool, error) {
+	if userID, _ := ctx.Value(UserID).(int); userID != 0 {
+		return c.Store.CheckID(ctx, id)
+	}
+
+	if e, ok := c.get(id); ok {
+		c.hits.Add(1)
+		return e.data, e.found, nil
+	}
+	c.misses.Add(1)
+
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+
+	if e, ok := c.getShared(ctx, id); ok {
+		c.sharedHits.Add(1)
+		c.put(gen, e)
+		return e.data, e.found, nil
+	}
+
+	data, found, err := c.Store.CheckID(ctx, id)
+	if err != nil {
+		return data, found, err
+	}
+	e := cacheEntry{id: id, data: data, found: found}
+	if c.put(gen, e) {
+		c.setShared(ctx, e)
+	}
+	return data, found, nil
+}
+
+func (c *CachedRepository) getShared(ctx context.Context, id string) (cacheEntry, bool) {
+	if c.opts.Shared == nil {
+		return cacheEntry{}, false
+	}
+	b, ok, err := c.opts.Shared.Get(ctx, sharedKeyPrefix+id)
+	if err != nil {
+		c.sharedError("Ошибка чтения общего кеша", err)
+		return cacheEntry{}, false
+	}
+	if !ok {
+		return cacheEntry{}, false
+	}
+	var v sharedEntry
+	if err := json.Unmarshal(b, &v); err != nil {
+		c.log.Error("Не разобрали значение общего кеша", zap.String("id", id), zap.Error(err))
+		return cacheEntry{}, false
+	}
+	if v.Tombstone {
+		return cacheEntry{}, false
+	}
+	e := cacheEntry{id: id, found: v.Found}
+	if v.Found {
+		e.data = URLData{ID: id, URL: v.URL, Deleted: v.Deleted}
+	}
+	return e, true
+}
+
+// setShared кладёт ответ хранилища в общий кеш, если ключа там нет. Отметку,
+// записанную delShared после изменения ссылки, устаревший ответ не перезапишет.
+func (c *CachedRepository) setShared(ctx context.Context, e cacheEntry) {
+	if c.opts.Shared == nil {
+		return
+	}
+	ttl := c.opts.TTL
+	if !e.found {
+		ttl = c.opts.NegativeTTL
+	}
+	b, err := json.Marshal(sharedEntry{URL: e.data.URL, Deleted: e.data.Deleted, Found: e.found})
+	if err != nil {
+		return
+	}
+	if _, err := c.opts.Shared.Add(ctx, sharedKeyPrefix+e.id, b, ttl); err != nil {
+		c.sharedError("Ошибка записи в общий кеш", err)
+	}
+}
+
+// delShared заменяет изменённые ссылки в общем кеше отметками об изменении.
+// Остальные экземпляры сбрасывают их из локальных кешей по уведомлению хранилища.
+func (c *CachedRepository) delShared(ctx context.Context, ids []string) {
+	if c.opts.Shared == nil || len(ids) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, sharedKeyPrefix+id)
+	}
+	tombstone, _ := json.Marshal(sharedEntry{Tombstone: true})
+	if err := c.opts.Shared.SetMany(ctx, keys, tombstone, sharedTombstoneTTL); err != nil {
+		c.sharedError("Ошибка удаления из общего кеша", err)
+	}
+}
+
+func (c *CachedRepository) sharedError(msg string, err error) {
+	c.sharedErrors.Add(1)
+	// при разомкнутом автомате ошибка на каждый запрос, не засоряем лог
+	if errors.Is(err, ErrCacheUnavailable) {
+		c.log.Debug(msg, zap.Error(err))
+		return
+	}
+	c.log.Error(msg, zap.Error(err))
+}
+
+func (c *CachedRepository) get(id string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[id]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, id)
+		return cacheEntry{}, false
+	}
+	c.ll.MoveToFront(el)
+	return *e, true
+}
+
+// put кладёт ответ в локальный кеш и сообщает, можно ли его кешировать:
+// false, если промахи не кешируются или за время запроса была инвалидация
+func (c *CachedRepository) put(gen uint64, e cacheEntry) bool {
+	ttl := c.opts.TTL
+	if !e.found {
+		ttl = c.opts.NegativeTTL
+		if ttl <= 0 {
+			return false
+		}
+	}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return false
+	}
+	// локальный кеш отключён, остаётся только общий
+	if c.opts.Size <= 0 {
+		return true
+	}
+	if el, ok := c.items[e.id]; ok {
+		el.Value = &e
+		c.ll.MoveToFront(el)
+		return true
+	}
+	c.items[e.id] = c.ll.PushFront(&e)
+	for c.ll.Len() > c.opts.Size {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*cacheEntry).id)
+		c.evictions.Add(1)
+	}
+	return true
+}
+
+// Invalidate убирает ссылки из кеша. Вызывается при изменении ссылок,
+// в том числе другими экземплярами сервиса.
+func (c *CachedRepository) Invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, id := range ids {
+		if el, ok := c.items[id]; ok {
+			c.ll.Remove(el)
+			delete(c.items, id)
+		}
+	}
+}
+
+// Purge очищает кеш целиком
+func (c *CachedRepository) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.ll.Init()
+	c.items = make(map[string]*list.Element, c.opts.Size)
+}
+
+// Apply применяет изменение, полученное от ChangeListener. Общий кеш уже
+// очистил экземпляр, изменивший ссылки, поэтому сбрасывается только локальный.
+func (c *CachedRepository) Apply(ev ChangeEvent) {
+	if ev.Op == ChangePurge {
+		c.Purge()
+		return
+	}
+	c.Invalidate(ev.IDs...)
+}
+
+func (c *CachedRepository) CacheStats() CacheStats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		Evictions:    c.evictions.Load(),
+		Size:         size,
+		SharedHits:   c.sharedHits.Load(),
+		SharedErrors: c.sharedErrors.Load(),
+	}
+}
+
+// AddURL сбрасывает закешированный промах для нового ID
+func (c *CachedRepository) AddURL(ctx context.Context, data URLData) error {
+	err := c.Store.AddURL(ctx, data)
+	c.Invalidate(data.ID)
+	c.delShared(ctx, []string{data.ID})
+	return err
+}
+
+func (c *CachedRepository) WriteBatchURL(ctx context.Context, b *ReqBatchURLs) (*ReqBatchURLs, error) {
+	res, err := c.Store.WriteBatchURL(ctx, b)
+	ids := make([]string, 0, len(*b))
+	for _, v := range *b {
+		ids = append(ids, v.ID)
+	}
+	c.Invalidate(ids...)
+	c.delShared(ctx, ids)
+	return res, err
+}
+
+func (c *CachedRepository) RemoveURL(ctx context.Context, data []URLData) error {
+	err := c.Store.RemoveURL(ctx, data)
+	ids := make([]string, 0, len(data))
+	for _, v := range data {
+		ids = append(ids, v.ID)
+	}
+	c.Invalidate(ids...)
+	c.delShared(ctx, ids)
+	return err
+}
+
+// Журнал удалений пробрасывается в хранилище, если оно его поддерживает
+
+func (c *CachedRepository) AppendDeletes(ctx context.Context, tasks []DeleteTask) error {
+	if j, ok := c.Store.(DeleteJournal); ok {
+		return j.AppendDeletes(ctx, tasks)
+	}
+	return nil
+}
+
+func (c *CachedRepository) AckDeletes(ctx context.Context, tasks []DeleteTask) error {
+	if j, ok := c.Store.(DeleteJournal); ok {
+		return j.AckDeletes(ctx, tasks)
+	}
+	return nil
+}
+
+func (c *CachedRepository) PendingDeletes(ctx context.Context) ([]DeleteTask, error) {
+	if j, ok := c.Store.(DeleteJournal); ok {
+		return j.PendingDeletes(ctx)
+	}
+	return nil, nil
+}
+
+// Close выводит итоговые счётчики кеша и закрывает хранилище и общий кеш
+func (c *CachedRepository) Close() error {
+	stats := c.CacheStats()
+	c.log.Info("Статистика кеша ссылок",
+		zap.Uint64("hits", stats.Hits), zap.Uint64("misses", stats.Misses),
+		zap.Uint64("evictions", stats.Evictions), zap.Int("size", stats.Size),
+		zap.Uint64("shared_hits", stats.SharedHits), zap.Uint64("shared_errors", stats.SharedErrors))
+	if closer, ok := c.opts.Shared.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			c.log.Error("Ошибка закрытия общего кеша", zap.Error(err))
+		}
+	}
+	return c.Store.Close()
+}
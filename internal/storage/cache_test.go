@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// countingStore считает обращения к хранилищу за ссылкой
+type countingStore struct {
+	*InternalStorage
+	lookups atomic.Int64
+}
+
+func (s *countingStore) CheckID(ctx context.Context, id string) (URLData, bool, error) {
+	s.lookups.Add(1)
+	return s.InternalStorage.CheckID(ctx, id)
+}
+
+func newCachedStore(opts CacheOptions) (*CachedRepository, *countingStore) {
+	inner := &countingStore{InternalStorage: NewMemoryStorage(zap.NewNop())}
+	return NewCachedRepository(inner, zap.NewNop(), opts), inner
+}
+
+func TestCachedRepository(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("hit", func(t *testing.T) {
+		c, inner := newCachedStore(CacheOptions{Size: 10, TTL: time.Minute})
+		require.NoError(t, c.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+
+		for i := 0; i < 3; i++ {
+			data, ok, err := c.CheckID(ctx, "AAAAaaaa")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "http://ya.ru", data.URL)
+		}
+		assert.Equal(t, int64(1), inner.lookups.Load())
+		assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Size: 1}, c.CacheStats())
+	})
+
+	t.Run("negative and add", func(t *testing.T) {
+		c, inner := newCachedStore(CacheOptions{Size: 10, NegativeTTL: time.Minute})
+		for i := 0; i < 2; i++ {
+			_, ok, err := c.CheckID(ctx, "AAAAaaaa")
+			require.NoError(t, err)
+			assert.False(t, ok)
+		}
+		assert.Equal(t, int64(1), inner.lookups.Load())
+
+		require.NoError(t, c.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+		_, ok, err := c.CheckID(ctx, "AAAAaaaa")
+		require.NoError(t, err)
+		assert.True(t, ok, "промах сбрасывается при добавлении ссылки")
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		c, _ := newCachedStore(CacheOptions{Size: 10})
+		require.NoError(t, c.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+		data, _, _ := c.CheckID(ctx, "AAAAaaaa")
+		require.False(t, data.Deleted)
+
+		require.NoError(t, c.RemoveURL(userContext(1), []URLData{{ID: "AAAAaaaa"}}))
+		data, _, _ = c.CheckID(ctx, "AAAAaaaa")
+		assert.True(t, data.Deleted)
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		c, inner := newCachedStore(CacheOptions{Size: 2})
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, c.AddURL(userContext(1), URLData{ID: id, URL: "http://" + id}))
+		}
+		for _, id := range []string{"a", "b", "a", "c", "a", "b"} {
+			_, _, err := c.CheckID(ctx, id)
+			require.NoError(t, err)
+		}
+		// a, b — промахи; a — попадание; c вытесняет b; a — попадание; b вытесняет c
+		assert.Equal(t, int64(4), inner.lookups.Load())
+		assert.Equal(t, uint64(2), c.CacheStats().Evictions)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		c, inner := newCachedStore(CacheOptions{Size: 10, TTL: 10 * time.Millisecond})
+		require.NoError(t, c.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+		_, _, _ = c.CheckID(ctx, "AAAAaaaa")
+		time.Sleep(20 * time.Millisecond)
+		_, _, _ = c.CheckID(ctx, "AAAAaaaa")
+		assert.Equal(t, int64(2), inner.lookups.Load())
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		c, inner := newCachedStore(CacheOptions{Size: 10})
+		for _, id := range []string{"a", "b"} {
+			require.NoError(t, c.AddURL(userContext(1), URLData{ID: id, URL: "http://" + id}))
+			_, _, _ = c.CheckID(ctx, id)
+		}
+
+		// изменение от другого экземпляра сбрасывает только указанные ссылки
+		c.Apply(ChangeEvent{Op: ChangeDeleted, IDs: []string{"a"}})
+		assert.Equal(t, 1, c.CacheStats().Size)
+		_, _, _ = c.CheckID(ctx, "b")
+		assert.Equal(t, int64(2), inner.lookups.Load())
+
+		c.Apply(ChangeEvent{Op: ChangePurge})
+		assert.Equal(t, 0, c.CacheStats().Size)
+	})
+
+	t.Run("user scoped", func(t *testing.T) {
+		c, inner := newCachedStore(CacheOptions{Size: 10})
+		for i := 0; i < 2; i++ {
+			_, _, err := c.CheckID(userContext(1), "AAAAaaaa")
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int64(2), inner.lookups.Load())
+		assert.Equal(t, 0, c.CacheStats().Size)
+	})
+}
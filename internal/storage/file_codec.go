@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Encoding формат записей файла бекапа
+type Encoding string
+
+const (
+	// EncodingJSON текстовые записи: контрольная сумма и JSON в одной строке
+	EncodingJSON Encoding = "jsonl"
+	// EncodingBinary компактные двоичные записи с длиной и контрольной суммой
+	EncodingBinary Encoding = "binary"
+	// encodingLegacy файлы первой версии без заголовка и контрольных сумм, только для чтения
+	encodingLegacy Encoding = "legacy"
+)
+
+const (
+	fileFormat        = "urlshortner"
+	fileFormatVersion = 2
+	// maxRecordSize ограничение на размер записи, чтобы испорченная длина не привела к огромному чтению
+	maxRecordSize = 16 << 20
+)
+
+// ErrCorruptFile в середине файла испорчена граница записи. Отрезать файл
+// нельзя: после неё лежат целые записи, которые нельзя найти.
+var ErrCorruptFile = errors.New("file storage is corrupted")
+
+var (
+	// errTornRecord запись обрезана: процесс упал посередине записи
+	errTornRecord = errors.New("torn record")
+	// errCorruptRecord запись целиком на месте, но не совпала контрольная сумма или формат
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(s); e {
+	case EncodingJSON, EncodingBinary:
+		return e, nil
+	case "":
+		return EncodingJSON, nil
+	default:
+		return "", fmt.Errorf("unknown file encoding %q", s)
+	}
+}
+
+// fileHeader первая строка файла бекапа, описывает формат остальных записей
+type fileHeader struct {
+	Format    string   `json:"format"`
+	Version   int      `json:"version"`
+	Encoding  Encoding `json:"encoding"`
+	Encrypted bool     `json:"encrypted,omitempty"`
+}
+
+// recordCodec кодирует записи в байты и обрамляет их в файле
+type recordCodec struct {
+	encoding  Encoding
+	encrypted bool
+	keys      *keyring
+}
+
+func newRecordCodec(encoding Encoding, keys *keyring) recordCodec {
+	return recordCodec{encoding: encoding, encrypted: keys != nil, keys: keys}
+}
+
+// sameFormat сообщает, можно ли дописывать записи c в файл формата o
+func (c recordCodec) sameFormat(o recordCodec) bool {
+	return c.encoding == o.encoding && c.encrypted == o.encrypted
+}
+
+func (c recordCodec) writeHeader(w io.Writer) error {
+	h, err := json.Marshal(fileHeader{Format: fileFormat, Version: fileFormatVersion, Encoding: c.encoding, Encrypted: c.encrypted})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(h, '\n'))
+	return err
+}
+
+// readHeader читает заголовок файла. Файлы без заголовка считаются файлами первой версии,
+// и размер заголовка для них равен нулю.
+func readHeader(r io.Reader) (recordCodec, int64, error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return recordCodec{}, 0, err
+	}
+
+	var h fileHeader
+	if json.Unmarshal(bytes.TrimSpace(line), &h) != nil || h.Format != fileFormat {
+		return recordCodec{encoding: encodingLegacy}, 0, nil
+	}
+	if h.Version > fileFormatVersion {
+		return recordCodec{}, 0, fmt.Errorf("unsupported file version %d", h.Version)
+	}
+	if _, err := ParseEncoding(string(h.Encoding)); err != nil {
+		return recordCodec{}, 0, err
+	}
+	return recordCodec{encoding: h.Encoding, encrypted: h.Encrypted}, int64(len(line)), nil
+}
+
+func (c recordCodec) marshal(r URLInFile) ([]byte, error) {
+	var plain []byte
+	if c.encoding == EncodingBinary {
+		plain = marshalBinaryRecord(r)
+	} else {
+		var err error
+		if plain, err = json.Marshal(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.encrypted {
+		return plain, nil
+	}
+	return c.keys.seal(plain)
+}
+
+// unmarshal декодирует запись. Второе значение ложно, если запись зашифрована
+// прежним ключом и её нужно перешифровать при сжатии.
+func (c recordCodec) unmarshal(b []byte) (URLInFile, bool, error) {
+	current := true
+	if c.encrypted {
+		if c.keys == nil {
+			return URLInFile{}, false, ErrKeyRequired
+		}
+		var err error
+		if b, current, err = c.keys.open(b); err != nil {
+			return URLInFile{}, false, err
+		}
+	}
+
+	if c.encoding == EncodingBinary {
+		r, err := unmarshalBinaryRecord(b)
+		return r, current, err
+	}
+	var r URLInFile
+	err := json.Unmarshal(b, &r)
+	return r, current, err
+}
+
+// writeFrame дописывает запись вместе с контрольной суммой
+func (c recordCodec) writeFrame(w io.Writer, payload []byte) error {
+	if c.encoding == EncodingBinary {
+		var head [8]byte
+		binary.BigEndian.PutUint32(head[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(head[4:], crc32.Checksum(payload, crcTable))
+		if _, err := w.Write(head[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(payload)
+		return err
+	}
+
+	if c.encrypted {
+		// шифротекст в текстовом формате храним в base64
+		payload = []byte(base64.StdEncoding.EncodeToString(payload))
+	}
+
+	line := make([]byte, 0, len(payload)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.Checksum(payload, crcTable))...)
+	line = append(line, payload...)
+	_, err := w.Write(append(line, '\n'))
+	return err
+}
+
+// readFrame читает следующую запись. Возвращает io.EOF в конце файла,
+// errTornRecord для обрезанной записи и errCorruptRecord для испорченной.
+// n — сколько байт файла занимает прочитанная запись.
+func (c recordCodec) readFrame(r *bufio.Reader) ([]byte, int64, error) {
+	if c.encoding == EncodingBinary {
+		return readBinaryFrame(r)
+	}
+
+	line, err := r.ReadBytes('\n')
+	n := int64(len(line))
+	switch {
+	case errors.Is(err, io.EOF) && n == 0:
+		return nil, 0, io.EOF
+	case errors.Is(err, io.EOF):
+		return nil, n, errTornRecord
+	case err != nil:
+		return nil, n, err
+	}
+	line = line[:len(line)-1]
+
+	if c.encoding == encodingLegacy {
+		if !json.Valid(line) {
+			return nil, n, errCorruptRecord
+		}
+		return line, n, nil
+	}
+
+	if len(line) < 9 || line[8] != ' ' {
+		return nil, n, errCorruptRecord
+	}
+	sum, err := hex.DecodeString(string(line[:8]))
+	if err != nil || binary.BigEndian.Uint32(sum) != crc32.Checksum(line[9:], crcTable) {
+		return nil, n, errCorruptRecord
+	}
+	if c.encrypted {
+		payload, err := base64.StdEncoding.DecodeString(string(line[9:]))
+		if err != nil {
+			return nil, n, errCorruptRecord
+		}
+		return payload, n, nil
+	}
+	return line[9:], n, nil
+}
+
+func readBinaryFrame(r *bufio.Reader) ([]byte, int64, error) {
+	var head [8]byte
+	read, err := io.ReadFull(r, head[:])
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, 0, io.EOF
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, int64(read), errTornRecord
+	case err != nil:
+		return nil, int64(read), err
+	}
+
+	size := binary.BigEndian.Uint32(head[:4])
+	if size > maxRecordSize {
+		// обрыв бывает только в конце файла; испорченная длина посередине — порча
+		if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+			return nil, 8, errTornRecord
+		}
+		return nil, 8, fmt.Errorf("%w: record length %d exceeds %d", ErrCorruptFile, size, maxRecordSize)
+	}
+
+	payload := make([]byte, size)
+	read, err = io.ReadFull(r, payload)
+	n := int64(8 + read)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, n, errTornRecord
+	case err != nil:
+		return nil, n, err
+	}
+
+	if binary.BigEndian.Uint32(head[4:]) != crc32.Checksum(payload, crcTable) {
+		return nil, n, errCorruptRecord
+	}
+	return payload, n, nil
+}
+
+// двоичная запись: флаги, ID пользователя, ID ссылки и URL с длинами в varint
+const (
+	binFlagDelete = 1 << iota
+	binFlagUser
+	binFlagDeleted
+)
+
+func marshalBinaryRecord(r URLInFile) []byte {
+	var flags byte
+	switch r.Op {
+	case opDelete:
+		flags |= binFlagDelete
+	case opUser:
+		flags |= binFlagUser
+	}
+	if r.Deleted {
+		flags |= binFlagDeleted
+	}
+
+	b := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(r.ID)+len(r.URL))
+	b = append(b, flags)
+	b = binary.AppendUvarint(b, uint64(r.UserID))
+	b = binary.AppendUvarint(b, uint64(len(r.ID)))
+	b = append(b, r.ID...)
+	b = binary.AppendUvarint(b, uint64(len(r.URL)))
+	return append(b, r.URL...)
+}
+
+func unmarshalBinaryRecord(b []byte) (URLInFile, error) {
+	var r URLInFile
+	if len(b) < 1 {
+		return r, errCorruptRecord
+	}
+	flags := b[0]
+	b = b[1:]
+
+	userID, n := binary.Uvarint(b)
+	if n <= 0 {
+		return r, errCorruptRecord
+	}
+	b = b[n:]
+
+	id, b, ok := readBinaryString(b)
+	if !ok {
+		return r, errCorruptRecord
+	}
+	url, b, ok := readBinaryString(b)
+	if !ok || len(b) != 0 {
+		return r, errCorruptRecord
+	}
+
+	r.UserID = int(userID)
+	r.ID = id
+	r.URL = url
+	r.Deleted = flags&binFlagDeleted != 0
+	switch {
+	case flags&binFlagDelete != 0:
+		r.Op = opDelete
+	case flags&binFlagUser != 0:
+		r.Op = opUser
+	}
+	return r, nil
+}
+
+func readBinaryString(b []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return "", nil, false
+	}
+	b = b[n:]
+	return string(b[:size]), b[size:], true
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("record is encrypted with unknown key")
+var ErrKeyRequired = errors.New("file is encrypted, key required")
+
+// keyIDSize запись начинается с идентификатора ключа, чтобы после ротации
+// можно было прочитать записи, зашифрованные прежним ключом
+const keyIDSize = 4
+
+// keyring ключи шифрования файла бекапа. Новые записи шифруются текущим ключом,
+// прежние ключи используются только для чтения до ближайшего сжатия файла.
+type keyring struct {
+	currentID uint32
+	aeads     map[uint32]cipher.AEAD
+}
+
+func newKeyring(current []byte, old [][]byte) (*keyring, error) {
+	if len(current) == 0 {
+		return nil, nil
+	}
+
+	k := &keyring{aeads: make(map[uint32]cipher.AEAD, len(old)+1)}
+	for i, key := range append([][]byte{current}, old...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		if i == 0 {
+			k.currentID = id
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+func keyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:keyIDSize])
+}
+
+// seal шифрует запись текущим ключом: идентификатор ключа, nonce и шифротекст
+func (k *keyring) seal(plain []byte) ([]byte, error) {
+	aead := k.aeads[k.currentID]
+
+	out := make([]byte, keyIDSize+aead.NonceSize(), keyIDSize+aead.NonceSize()+len(plain)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, k.currentID)
+	nonce := out[keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// идентификатор ключа входит в аутентифицированные данные
+	return aead.Seal(out, nonce, plain, out[:keyIDSize]), nil
+}
+
+// open расшифровывает запись. Второе значение сообщает, зашифрована ли запись текущим ключом.
+func (k *keyring) open(sealed []byte) ([]byte, bool, error) {
+	if len(sealed) < keyIDSize {
+		return nil, false, errCorruptRecord
+	}
+	id := binary.BigEndian.Uint32(sealed)
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, false, ErrUnknownKey
+	}
+	if len(sealed) < keyIDSize+aead.NonceSize() {
+		return nil, false, errCorruptRecord
+	}
+
+	nonce := sealed[keyIDSize : keyIDSize+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[keyIDSize+aead.NonceSize():], sealed[:keyIDSize])
+	if err != nil {
+		return nil, false, errCorruptRecord
+	}
+	return plain, id == k.currentID, nil
+}
+
+// ParseKey разбирает ключ AES (16, 24 или 32 байта) в hex или base64
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("key must be hex or base64: %w", err)
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid key size %d, want 16, 24 or 32 bytes", len(key))
+	}
+}
+
+// ParseKeys разбирает список ключей через запятую
+func ParseKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for _, part := range strings.Split(s, ",") {
+		key, err := ParseKey(part)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+func (f *FileStorage) snapshotName() string {
+	return f.fileName + ".snapshot"
+}
+
+// Compact записывает живое состояние в новый снимок, атомарно подменяет им старый
+// и очищает хвост. Функция state вызывается при заблокированной записи в файл,
+// поэтому ни одна запись хвоста не теряется между снимком и очисткой.
+func (f *FileStorage) Compact(state func() []URLInFile) error {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	return f.compactLocked(state)
+}
+
+func (f *FileStorage) compactLocked(state func() []URLInFile) error {
+	records := state()
+	f.Log.Info("Сжимаем файл бекапа", zap.Int("records", len(records)), zap.Int("tail", f.tailRecords))
+
+	tmpName := f.snapshotName() + ".tmp"
+	if err := f.writeRecords(tmpName, records); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, f.snapshotName()); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(f.fileName)); err != nil {
+		return err
+	}
+
+	// если упадём до очистки хвоста, его записи повторно применятся поверх снимка
+	if err := os.Truncate(f.fileName, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f.tailRecords = 0
+	f.needHeader = true
+	return nil
+}
+
+func (f *FileStorage) writeRecords(name string, records []URLInFile) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	err = f.codec.writeHeader(w)
+	for i := 0; err == nil && i < len(records); i++ {
+		err = f.writeRecord(w, records[i])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeRecord кодирует запись и дописывает её в w вместе с контрольной суммой
+func (f *FileStorage) writeRecord(w io.Writer, r URLInFile) error {
+	payload, err := f.codec.marshal(r)
+	if err != nil {
+		return err
+	}
+	return f.codec.writeFrame(w, payload)
+}
+
+// syncDir сбрасывает на диск каталог, чтобы переименование файла пережило сбой питания
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
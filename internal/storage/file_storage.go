@@ -3,85 +3,521 @@ package storage
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/Taboon/urlshortner/internal/entity"
 	"go.uber.org/zap"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type FileStorage struct {
 	fileName string
 	Log      *zap.Logger
+	opts     FileOptions
+	mu       sync.Mutex // защищает файл журнала удалений
+
+	fileMu      sync.Mutex // защищает файл данных и снимок
+	file        *os.File
+	codec       recordCodec
+	keys        *keyring
+	needHeader  bool // файл данных пуст, перед первой записью нужен заголовок
+	tailRecords int  // количество записей в хвосте после последнего снимка
+	report      RestoreReport
+	compactCh   chan struct{}
+
+	writes     chan writeRequest
+	writerDone chan struct{}
+	closeMu    sync.RWMutex // защищает closed и отправку в writes
+	closed     bool
+}
+
+var _ DeleteJournal = (*FileStorage)(nil)
+
+// FileOptions настройки файла бекапа
+type FileOptions struct {
+	// CompactThreshold количество записей в хвосте, после которого файл сжимается в снимок.
+	// 0 отключает сжатие по размеру.
+	CompactThreshold int
+	// CompactInterval период фонового сжатия. 0 отключает сжатие по таймеру.
+	CompactInterval time.Duration
+	// Sync режим сброса записей на диск
+	Sync SyncMode
+	// SyncInterval период fsync в режиме SyncInterval
+	SyncInterval time.Duration
+	// Encoding формат новых записей
+	Encoding Encoding
+	// Key ключ AES для шифрования записей и журнала удалений. Пустой ключ отключает шифрование.
+	Key []byte
+	// OldKeys прежние ключи: ими только расшифровываются записи, при сжатии
+	// файл перешифровывается ключом Key
+	OldKeys [][]byte
 }
 
 type URLInFile struct {
-	ID     string `json:"id"`
-	URL    string `json:"url"`
-	UserID int    `json:"user_id"`
+	ID      string `json:"id"`
+	URL     string `json:"url,omitempty"`
+	UserID  int    `json:"user_id"`
+	Op      string `json:"op,omitempty"`
+	Deleted bool   `json:"is_deleted,omitempty"`
 }
 
-func NewFileStorage(fileName string, logger *zap.Logger) *FileStorage {
+const (
+	// opDelete запись-надгробие: URL с этим ID помечен удалённым
+	opDelete = "delete"
+	// opUser запись о выдаче нового ID пользователя
+	opUser = "user"
+)
+
+func NewFileStorage(fileName string, logger *zap.Logger, opts FileOptions) (*FileStorage, error) {
 	err := os.MkdirAll(filepath.Dir(fileName), 0774)
 	if err != nil {
 		logger.Error("Ошибка создания файла")
+		return nil, err
 	}
 	logger.Debug("Создали дирректорию", zap.String("dir", filepath.Dir(fileName)))
-	return &FileStorage{
-		fileName: fileName,
-		Log:      logger,
+
+	if opts.Sync == "" {
+		opts.Sync = SyncAlways
+	}
+	if opts.Sync == SyncInterval && opts.SyncInterval <= 0 {
+		opts.SyncInterval = 100 * time.Millisecond
 	}
+	if opts.Encoding == "" {
+		opts.Encoding = EncodingJSON
+	}
+
+	keys, err := newKeyring(opts.Key, opts.OldKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileStorage{
+		fileName:  fileName,
+		Log:       logger,
+		opts:      opts,
+		codec:     newRecordCodec(opts.Encoding, keys),
+		keys:      keys,
+		compactCh: make(chan struct{}, 1),
+	}
+	if err := f.startWriter(); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
-func (f *FileStorage) Set(url URLInFile) error {
-	file, err := os.OpenFile(f.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// OpenFileStorage открывает хранилище в памяти с бекапом в файл по DSN вида
+// file:///var/lib/shortener.json?sync=interval&encoding=binary, загружает данные
+// из файла и запускает фоновое сжатие. Ключи шифрования берутся из o.
+func OpenFileStorage(ctx context.Context, dsn string, o Options, l *zap.Logger) (Store, error) {
+	path, query, err := dsnPath(dsn, "file")
+	if err != nil {
+		return nil, err
+	}
+	opts, err := ParseFileOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	opts.Key, opts.OldKeys = o.FileKey, o.FileOldKeys
+	maxLen, err := ParseMaxURLLength(query)
 	if err != nil {
+		return nil, err
+	}
+
+	l.Info("Используем бекап файл", zap.String("file", path))
+	backuper, err := NewFileStorage(path, l, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	stor := NewMemoryStorage(l)
+	stor.MaxURLLength = maxLen
+	if err := backuper.Get(stor); err != nil {
+		_ = backuper.Close()
+		return nil, err
+	}
+	stor.Backuper = backuper
+	stor.StartCompactor(ctx)
+	return stor, nil
+}
+
+// ParseFileOptions разбирает настройки файла бекапа из параметров DSN:
+// compact_records, compact_interval, sync, sync_interval, encoding.
+// Ключи шифрования в DSN не принимаются, они передаются через Options.
+func ParseFileOptions(q url.Values) (FileOptions, error) {
+	var opts FileOptions
+	var err error
+
+	if q.Has("key") || q.Has("old_keys") {
+		return opts, errors.New("file keys are not accepted in dsn, use FILE_STORAGE_KEY and FILE_STORAGE_OLD_KEYS")
+	}
+
+	if v := q.Get("compact_records"); v != "" {
+		if opts.CompactThreshold, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("compact_records: %w", err)
+		}
+	}
+	if v := q.Get("compact_interval"); v != "" {
+		if opts.CompactInterval, err = time.ParseDuration(v); err != nil {
+			return opts, fmt.Errorf("compact_interval: %w", err)
+		}
+	}
+	if opts.Sync, err = ParseSyncMode(q.Get("sync")); err != nil {
+		return opts, err
+	}
+	if v := q.Get("sync_interval"); v != "" {
+		if opts.SyncInterval, err = time.ParseDuration(v); err != nil {
+			return opts, fmt.Errorf("sync_interval: %w", err)
+		}
+	}
+	if opts.Encoding, err = ParseEncoding(q.Get("encoding")); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (f *FileStorage) Set(url URLInFile) error {
+	return f.append(url)
+}
+
+// RemoveURL дописывает в файл надгробия для удалённых URL пользователя
+func (f *FileStorage) RemoveURL(_ context.Context, userID int, data []URLData) error {
+	records := make([]URLInFile, 0, len(data))
+	for _, v := range data {
+		records = append(records, URLInFile{ID: v.ID, UserID: userID, Op: opDelete})
+	}
+	return f.append(records...)
+}
+
+// requestCompaction сообщает фоновому сжатию, что хвост превысил порог
+func (f *FileStorage) requestCompaction() {
+	if f.opts.CompactThreshold <= 0 || f.tailRecords < f.opts.CompactThreshold {
+		return
+	}
+	select {
+	case f.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// RestoreReport итоги чтения файла бекапа при старте
+type RestoreReport struct {
+	// Records количество применённых записей
+	Records int
+	// Corrupted количество пропущенных записей с неверной контрольной суммой
+	Corrupted int
+	// TruncatedBytes сколько байт недописанного хвоста отрезано
+	TruncatedBytes int64
+}
+
+// Get загружает в хранилище снимок и дописанный после него хвост.
+// Недописанный хвост отрезается, испорченные записи пропускаются и попадают в отчёт.
+func (f *FileStorage) Get(repository *InternalStorage) error {
+	if repository == nil {
+		return entity.ErrRepositoryNotInitialized
+	}
+
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	snapshot, err := f.load(f.snapshotName(), repository, false)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tail, err := f.load(f.fileName, repository, true)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	f.tailRecords = tail.records
+
+	f.Log.Info("Загрузили файл бекапа",
+		zap.Int("records", f.report.Records),
+		zap.Int("corrupted", f.report.Corrupted),
+		zap.Int64("truncated_bytes", f.report.TruncatedBytes))
+
+	// файлы старого формата, другой кодировки или зашифрованные прежним ключом
+	// переписываем в текущем формате через снимок
+	switch {
+	case !f.needHeader && !tail.codec.sameFormat(f.codec),
+		snapshot.records > 0 && !snapshot.codec.sameFormat(f.codec),
+		snapshot.staleKey+tail.staleKey > 0:
+		f.Log.Info("Переводим файл бекапа в текущий формат",
+			zap.String("encoding", string(f.codec.encoding)), zap.Bool("encrypted", f.codec.encrypted))
+		return f.compactLocked(repository.snapshot)
+	}
+	return nil
+}
+
+// Report возвращает итоги последней загрузки файла бекапа
+func (f *FileStorage) Report() RestoreReport {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	return f.report
+}
+
+type loadResult struct {
+	codec    recordCodec
+	records  int
+	staleKey int // записи, зашифрованные прежним ключом
+}
+
+// load применяет записи файла к хранилищу. Если truncate выставлен, недописанные
+// записи в конце файла отрезаются, чтобы новые записи шли сразу за последней целой.
+func (f *FileStorage) load(name string, repository *InternalStorage, truncate bool) (loadResult, error) {
+	var res loadResult
+	file, err := os.Open(name)
+	if err != nil {
+		return res, err
+	}
 	defer func() {
 		err := file.Close()
 		if err != nil {
 			f.Log.Error("Ошибка закрытия файла", zap.Error(err))
 		}
 	}()
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(url)
-}
 
-func (f *FileStorage) Get(repository *InternalStorage) error {
-	if repository == nil {
-		return entity.ErrRepositoryNotInitialized
+	codec, offset, err := readHeader(file)
+	if err != nil {
+		return res, err
+	}
+	if codec.encrypted {
+		if f.keys == nil {
+			return res, ErrKeyRequired
+		}
+		codec.keys = f.keys
+	}
+	res.codec = codec
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return res, err
 	}
 
-	var data = URLInFile{}
-	file, err := os.OpenFile(f.fileName, os.O_RDONLY|os.O_CREATE, 0774)
+	r := bufio.NewReader(file)
+	good := offset // конец последней целой записи
+	corrupted := 0 // испорченные записи после последней целой
+
+	for {
+		payload, n, err := codec.readFrame(r)
+		offset += n
+		if errors.Is(err, io.EOF) || errors.Is(err, errTornRecord) {
+			break
+		}
+
+		var data URLInFile
+		current := true
+		if err == nil {
+			data, current, err = codec.unmarshal(payload)
+		}
+		if err != nil {
+			if errors.Is(err, ErrCorruptFile) {
+				return res, fmt.Errorf("%w: %s at offset %d", err, name, offset-n)
+			}
+			if !errors.Is(err, errCorruptRecord) && !isDecodeError(err) {
+				return res, err
+			}
+			f.Log.Error("Пропускаем повреждённую запись", zap.String("file", name), zap.Int64("offset", offset-n))
+			corrupted++
+			continue
+		}
+
+		f.report.Corrupted += corrupted
+		corrupted = 0
+		res.records++
+		if !current {
+			res.staleKey++
+		}
+		repository.restore(data)
+		good = offset
+	}
+
+	// испорченные записи в самом конце считаем недописанным хвостом
+	info, err := file.Stat()
+	if err != nil {
+		return res, err
+	}
+	f.report.Records += res.records
+	if good == info.Size() {
+		return res, nil
+	}
+	if !truncate {
+		f.report.Corrupted += corrupted
+		return res, nil
+	}
+	// в двоичном формате запись с неверной суммой могла сбить границы, и за ней
+	// остались бы целые записи. Отрезаем только обрыв последней записи.
+	if codec.encoding == EncodingBinary && corrupted > 0 {
+		return res, fmt.Errorf("%w: %s: %d corrupt records before offset %d", ErrCorruptFile, name, corrupted, info.Size())
+	}
+
+	f.Log.Error("Отрезаем недописанный хвост файла", zap.String("file", name), zap.Int64("bytes", info.Size()-good))
+	f.report.TruncatedBytes += info.Size() - good
+	return res, os.Truncate(name, good)
+}
+
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+func (f *FileStorage) deleteJournalName() string {
+	return f.fileName + ".delete"
+}
+
+func (f *FileStorage) AppendDeletes(_ context.Context, tasks []DeleteTask) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.deleteJournalName(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		err := file.Close()
 		if err != nil {
 			f.Log.Error("Ошибка закрытия файла", zap.Error(err))
 		}
 	}()
+
+	w := bufio.NewWriter(file)
+	for _, t := range tasks {
+		if err := f.writeDelete(w, t); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (f *FileStorage) PendingDeletes(_ context.Context) ([]DeleteTask, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readDeletes()
+}
+
+func (f *FileStorage) AckDeletes(_ context.Context, tasks []DeleteTask) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pending, err := f.readDeletes()
 	if err != nil {
 		return err
 	}
 
-	scanner := bufio.NewScanner(file)
+	done := make(map[DeleteTask]struct{}, len(tasks))
+	for _, t := range tasks {
+		done[t] = struct{}{}
+	}
 
-	// Читаем файл построчно
+	// переписываем журнал во временный файл и атомарно подменяем им старый
+	tmpName := f.deleteJournalName() + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, t := range pending {
+		if _, ok := done[t]; ok {
+			continue
+		}
+		if err := f.writeDelete(w, t); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, f.deleteJournalName())
+}
+
+func (f *FileStorage) readDeletes() ([]DeleteTask, error) {
+	file, err := os.Open(f.deleteJournalName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			f.Log.Error("Ошибка закрытия файла", zap.Error(err))
+		}
+	}()
+
+	var tasks []DeleteTask
+	seen := make(map[DeleteTask]struct{})
+	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Bytes()
-		if json.Valid(line) {
-			err := json.Unmarshal(line, &data)
-			if err != nil {
-				return err
-			}
+		t, err := f.readDelete(scanner.Bytes())
+		if errors.Is(err, ErrKeyRequired) || errors.Is(err, ErrUnknownKey) {
+			return nil, err
+		}
+		if err != nil {
+			// недописанная строка в конце журнала после аварийной остановки
+			f.Log.Error("Пропускаем повреждённую запись журнала удалений", zap.Error(err))
+			continue
 		}
-		repository.Users[data.UserID] = append(UserURLs{}, URLData{ID: data.ID, URL: data.URL})
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		tasks = append(tasks, t)
 	}
+	return tasks, scanner.Err()
+}
 
-	return nil
+// writeDelete дописывает задачу строкой журнала. С ключом строка шифруется так же,
+// как записи файла данных: в журнале лежат ID ссылок и их владельцы.
+func (f *FileStorage) writeDelete(w io.Writer, t DeleteTask) error {
+	line, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if f.keys != nil {
+		sealed, err := f.keys.seal(line)
+		if err != nil {
+			return err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
 }
 
-func (f *FileStorage) RemoveURL(_ context.Context, _ URLData) error { //
-	return nil
+// readDelete разбирает строку журнала. Открытые строки журнала, записанного
+// до включения шифрования, читаются и с ключом и перешифровываются при очистке.
+func (f *FileStorage) readDelete(line []byte) (DeleteTask, error) {
+	var t DeleteTask
+	if len(line) > 0 && line[0] != '{' {
+		if f.keys == nil {
+			return t, ErrKeyRequired
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return t, err
+		}
+		if line, _, err = f.keys.open(sealed); err != nil {
+			return t, err
+		}
+	}
+	return t, json.Unmarshal(line, &t)
 }
@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newFileBackedStorage(t *testing.T, file string) *InternalStorage {
+	t.Helper()
+	return newFileBackedStorageWith(t, file, FileOptions{})
+}
+
+func newFileBackedStorageWith(t *testing.T, file string, opts FileOptions) *InternalStorage {
+	t.Helper()
+	l := zap.NewNop()
+	is := NewMemoryStorage(l)
+	backuper, err := NewFileStorage(file, l, opts)
+	require.NoError(t, err)
+	require.NoError(t, backuper.Get(is))
+	is.Backuper = backuper
+	t.Cleanup(func() { _ = is.Close() })
+	return is
+}
+
+func userContext(id int) context.Context {
+	return context.WithValue(context.Background(), UserID, id)
+}
+
+func TestFileStorageRestoresDeletes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+
+	is := newFileBackedStorage(t, file)
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	require.NoError(t, is.AddURL(userContext(2), URLData{ID: "BBBBbbbb", URL: "http://yandex.ru"}))
+
+	// чужой URL не удаляется
+	require.NoError(t, is.RemoveURL(userContext(2), []URLData{{ID: "AAAAaaaa"}}))
+	require.NoError(t, is.RemoveURL(userContext(1), []URLData{{ID: "AAAAaaaa"}}))
+
+	v, ok, err := is.CheckID(context.Background(), "AAAAaaaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, v.Deleted)
+
+	restored := newFileBackedStorage(t, file)
+	v, ok, err = restored.CheckID(context.Background(), "AAAAaaaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, v.Deleted)
+
+	v, ok, err = restored.CheckID(context.Background(), "BBBBbbbb")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.False(t, v.Deleted)
+}
+
+func TestFileStorageRestoresAllURLsAndUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+
+	is := newFileBackedStorage(t, file)
+	first, err := is.GetNewUser(context.Background())
+	require.NoError(t, err)
+	second, err := is.GetNewUser(context.Background())
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	require.NoError(t, is.AddURL(userContext(first), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	require.NoError(t, is.AddURL(userContext(first), URLData{ID: "BBBBbbbb", URL: "http://yandex.ru"}))
+
+	restored := newFileBackedStorage(t, file)
+	urls, err := restored.GetURLsByUser(context.Background(), first)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+
+	// пользователь без ссылок тоже учитывается, ID не выдаются повторно
+	third, err := restored.GetNewUser(context.Background())
+	require.NoError(t, err)
+	assert.Greater(t, third, second)
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+
+	is := newFileBackedStorage(t, file)
+	user, err := is.GetNewUser(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, is.AddURL(userContext(user), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	require.NoError(t, is.AddURL(userContext(user), URLData{ID: "BBBBbbbb", URL: "http://yandex.ru"}))
+	require.NoError(t, is.RemoveURL(userContext(user), []URLData{{ID: "AAAAaaaa"}}))
+
+	require.NoError(t, is.Compact())
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size(), "хвост должен быть очищен после снимка")
+
+	// запись после снимка попадает в хвост
+	require.NoError(t, is.AddURL(userContext(user), URLData{ID: "CCCCcccc", URL: "http://go.dev"}))
+
+	restored := newFileBackedStorage(t, file)
+	urls, err := restored.GetURLsByUser(context.Background(), user)
+	require.NoError(t, err)
+	assert.Len(t, urls, 3)
+
+	v, ok, err := restored.CheckID(context.Background(), "AAAAaaaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, v.Deleted)
+
+	next, err := restored.GetNewUser(context.Background())
+	require.NoError(t, err)
+	assert.Greater(t, next, user)
+}
+
+func TestFileStorageGroupCommit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+	l := zap.NewNop()
+
+	for _, mode := range []SyncMode{SyncAlways, SyncInterval, SyncNone} {
+		t.Run(string(mode), func(t *testing.T) {
+			is := NewMemoryStorage(l)
+			backuper, err := NewFileStorage(file+string(mode), l, FileOptions{Sync: mode})
+			require.NoError(t, err)
+			is.Backuper = backuper
+
+			var wg sync.WaitGroup
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					assert.NoError(t, is.AddURL(userContext(1+i%5), URLData{ID: fmt.Sprintf("id%06d", i), URL: fmt.Sprintf("http://ya.ru/%d", i)}))
+				}(i)
+			}
+			wg.Wait()
+			require.NoError(t, is.Close())
+
+			restored := newFileBackedStorage(t, file+string(mode))
+			total := 0
+			for user := 1; user <= 5; user++ {
+				urls, err := restored.GetURLsByUser(context.Background(), user)
+				require.NoError(t, err)
+				total += len(urls)
+			}
+			assert.Equal(t, 100, total)
+		})
+	}
+}
+
+func TestFileStorageReadsLegacyFormat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+	legacy := `{"id":"AAAAaaaa","url":"http://ya.ru","user_id":1}
+not a json
+{"id":"BBBBbbbb","url":"http://yandex.ru","user_id":1}
+`
+	require.NoError(t, os.WriteFile(file, []byte(legacy), 0644))
+
+	is := newFileBackedStorage(t, file)
+	urls, err := is.GetURLsByUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2, "повреждённая строка не должна дублировать предыдущую запись")
+	assert.Equal(t, 1, is.Backuper.Report().Corrupted)
+
+	// после загрузки старый файл переведён в снимок нового формата
+	require.NoError(t, is.Close())
+	restored := newFileBackedStorage(t, file)
+	urls, err = restored.GetURLsByUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+	assert.Zero(t, restored.Backuper.Report().Corrupted)
+}
+
+func TestFileStorageRecovery(t *testing.T) {
+	for _, enc := range []Encoding{EncodingJSON, EncodingBinary} {
+		t.Run(string(enc), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "db")
+			opts := FileOptions{Encoding: enc}
+
+			is := newFileBackedStorageWith(t, file, opts)
+			for _, id := range []string{"AAAAaaaa", "BBBBbbbb", "CCCCcccc"} {
+				require.NoError(t, is.AddURL(userContext(1), URLData{ID: id, URL: "http://" + id + ".ru"}))
+			}
+			require.NoError(t, is.Close())
+
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			size := len(data)
+
+			// портим байт в середине второй записи и имитируем недописанную запись в конце
+			data[size/2] ^= 0xff
+			data = append(data, data[len(data)-10:len(data)-3]...)
+			require.NoError(t, os.WriteFile(file, data, 0644))
+
+			restored := newFileBackedStorageWith(t, file, opts)
+			report := restored.Backuper.Report()
+			assert.Equal(t, 2, report.Records)
+			assert.Equal(t, 1, report.Corrupted)
+			assert.Equal(t, int64(7), report.TruncatedBytes)
+
+			info, err := os.Stat(file)
+			require.NoError(t, err)
+			assert.Equal(t, int64(size), info.Size())
+
+			// новые записи продолжают файл сразу за последней целой
+			require.NoError(t, restored.AddURL(userContext(1), URLData{ID: "DDDDdddd", URL: "http://go.dev"}))
+			require.NoError(t, restored.Close())
+			again := newFileBackedStorageWith(t, file, opts)
+			urls, err := again.GetURLsByUser(context.Background(), 1)
+			require.NoError(t, err)
+			assert.Len(t, urls, 3)
+		})
+	}
+}
+
+func TestFileStorageBinaryCorruption(t *testing.T) {
+	opts := FileOptions{Encoding: EncodingBinary}
+	write := func(t *testing.T) (string, []byte) {
+		file := filepath.Join(t.TempDir(), "db")
+		is := newFileBackedStorageWith(t, file, opts)
+		for _, id := range []string{"AAAAaaaa", "BBBBbbbb", "CCCCcccc"} {
+			require.NoError(t, is.AddURL(userContext(1), URLData{ID: id, URL: "http://" + id + ".ru"}))
+		}
+		require.NoError(t, is.Close())
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		return file, data
+	}
+	// заголовок записи: длина и сумма, затем флаги, пользователь и длина ID
+	frameStart := func(data []byte, id string) int {
+		return bytes.Index(data, []byte(id)) - 3 - 8
+	}
+	open := func(file string) error {
+		backuper, err := NewFileStorage(file, zap.NewNop(), opts)
+		require.NoError(t, err)
+		defer backuper.Close()
+		return backuper.Get(NewMemoryStorage(zap.NewNop()))
+	}
+
+	t.Run("length in the middle", func(t *testing.T) {
+		file, data := write(t)
+		binary.BigEndian.PutUint32(data[frameStart(data, "BBBBbbbb"):], maxRecordSize+1)
+		require.NoError(t, os.WriteFile(file, data, 0644))
+
+		require.ErrorIs(t, open(file), ErrCorruptFile)
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), info.Size(), "целые записи после порчи не отрезаются")
+	})
+
+	t.Run("checksum before the end", func(t *testing.T) {
+		file, data := write(t)
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(file, data, 0644))
+
+		require.ErrorIs(t, open(file), ErrCorruptFile)
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), info.Size())
+	})
+
+	t.Run("torn length at the end", func(t *testing.T) {
+		file, data := write(t)
+		head := make([]byte, 8)
+		binary.BigEndian.PutUint32(head, maxRecordSize+1)
+		require.NoError(t, os.WriteFile(file, append(data, head...), 0644))
+
+		restored := newFileBackedStorageWith(t, file, opts)
+		assert.Equal(t, 3, restored.Backuper.Report().Records)
+		assert.Equal(t, int64(8), restored.Backuper.Report().TruncatedBytes)
+	})
+}
+
+func TestFileStorageEncryption(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	for _, enc := range []Encoding{EncodingJSON, EncodingBinary} {
+		t.Run(string(enc), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "db")
+
+			is := newFileBackedStorageWith(t, file, FileOptions{Encoding: enc, Key: oldKey})
+			require.NoError(t, is.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://secret.example"}))
+			require.NoError(t, is.Close())
+
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), "secret.example")
+
+			_, err = loadFileStorage(file, FileOptions{Encoding: enc})
+			assert.ErrorIs(t, err, ErrKeyRequired)
+
+			// ротация: файл читается прежним ключом и перешифровывается новым
+			rotated := newFileBackedStorageWith(t, file, FileOptions{Encoding: enc, Key: newKey, OldKeys: [][]byte{oldKey}})
+			require.NoError(t, rotated.Close())
+
+			restored := newFileBackedStorageWith(t, file, FileOptions{Encoding: enc, Key: newKey})
+			v, ok, err := restored.CheckID(context.Background(), "AAAAaaaa")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, "http://secret.example", v.URL)
+		})
+	}
+}
+
+func TestFileStorageEncryptsDeleteJournal(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	file := filepath.Join(t.TempDir(), "db")
+	ctx := context.Background()
+	tasks := []DeleteTask{{ID: "AAAAaaaa", UserID: 1}, {ID: "BBBBbbbb", UserID: 2}}
+
+	// журнал, записанный до включения шифрования, читается и с ключом
+	plain, err := NewFileStorage(file, zap.NewNop(), FileOptions{})
+	require.NoError(t, err)
+	require.NoError(t, plain.AppendDeletes(ctx, tasks[:1]))
+	require.NoError(t, plain.Close())
+
+	f, err := NewFileStorage(file, zap.NewNop(), FileOptions{Key: oldKey})
+	require.NoError(t, err)
+	require.NoError(t, f.AppendDeletes(ctx, tasks[1:]))
+	require.NoError(t, f.Close())
+
+	data, err := os.ReadFile(file + ".delete")
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "BBBBbbbb")
+
+	noKey, err := NewFileStorage(file, zap.NewNop(), FileOptions{})
+	require.NoError(t, err)
+	_, err = noKey.PendingDeletes(ctx)
+	assert.ErrorIs(t, err, ErrKeyRequired)
+	require.NoError(t, noKey.Close())
+
+	// при очистке журнал перешифровывается текущим ключом
+	rotated, err := NewFileStorage(file, zap.NewNop(), FileOptions{Key: newKey, OldKeys: [][]byte{oldKey}})
+	require.NoError(t, err)
+	pending, err := rotated.PendingDeletes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, tasks, pending)
+	require.NoError(t, rotated.AckDeletes(ctx, tasks[:1]))
+	require.NoError(t, rotated.Close())
+
+	data, err = os.ReadFile(file + ".delete")
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "AAAAaaaa")
+
+	restored, err := NewFileStorage(file, zap.NewNop(), FileOptions{Key: newKey})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = restored.Close() })
+	pending, err = restored.PendingDeletes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, tasks[1:], pending)
+}
+
+// loadFileStorage загружает файл в новое хранилище и возвращает ошибку загрузки
+func loadFileStorage(file string, opts FileOptions) (*InternalStorage, error) {
+	l := zap.NewNop()
+	is := NewMemoryStorage(l)
+	backuper, err := NewFileStorage(file, l, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer backuper.Close()
+	return is, backuper.Get(is)
+}
+
+func TestFileStorageConcurrentCompaction(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.json")
+	is := newFileBackedStorage(t, file)
+
+	const writers, perWriter = 4, 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for user := 1; user <= writers; user++ {
+			wg.Add(1)
+			go func(user int) {
+				defer wg.Done()
+				for i := 0; i < perWriter; i++ {
+					id := fmt.Sprintf("%d%07d", user, i)
+					assert.NoError(t, is.AddURL(userContext(user), URLData{ID: id, URL: "http://ya.ru/" + id}))
+					if i%10 == 0 {
+						assert.NoError(t, is.RemoveURL(userContext(user), []URLData{{ID: id}}))
+					}
+				}
+			}(user)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				assert.NoError(t, is.Compact())
+			}
+		}()
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("сжатие и запись заблокировали друг друга")
+	}
+
+	restored := newFileBackedStorage(t, file)
+	for user := 1; user <= writers; user++ {
+		urls, err := restored.GetURLsByUser(context.Background(), user)
+		require.NoError(t, err)
+		assert.Len(t, urls, perWriter)
+	}
+}
+
+func TestFileStorageResetAfterWriteError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	opts := FileOptions{Encoding: EncodingBinary}
+
+	is := newFileBackedStorageWith(t, file, opts)
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+
+	// подменяем файл дескриптором только для чтения: следующая группа не запишется
+	f := is.Backuper
+	ro, err := os.Open(file)
+	require.NoError(t, err)
+	f.fileMu.Lock()
+	rw := f.file
+	f.file = ro
+	f.fileMu.Unlock()
+	require.Error(t, is.AddURL(userContext(1), URLData{ID: "BBBBbbbb", URL: "http://yandex.ru"}))
+	require.NoError(t, rw.Close())
+
+	// после ошибки писатель переоткрыл файл и продолжает писать
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "CCCCcccc", URL: "http://go.dev"}))
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+
+	// обрывок группы отрезается до последней целой записи
+	out, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = out.Write([]byte("обрывок"))
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+	f.resetFile(info.Size())
+
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "DDDDdddd", URL: "http://go.dev/doc"}))
+	require.NoError(t, is.Close())
+
+	restored := newFileBackedStorageWith(t, file, opts)
+	urls, err := restored.GetURLsByUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 3)
+	assert.Zero(t, restored.Backuper.Report().Corrupted)
+	assert.Zero(t, restored.Backuper.Report().TruncatedBytes)
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"go.uber.org/zap"
+)
+
+// SyncMode режим сброса файла бекапа на диск
+type SyncMode string
+
+const (
+	// SyncAlways fsync после каждой группы записей: подтверждённая запись переживает сбой питания
+	SyncAlways SyncMode = "always"
+	// SyncInterval fsync по таймеру: при сбое теряются записи не старше SyncInterval
+	SyncInterval SyncMode = "interval"
+	// SyncNone сброс на диск выполняет ОС: переживает падение процесса, но не сбой питания
+	SyncNone SyncMode = "none"
+)
+
+// maxGroupCommit сколько запросов на запись объединяется в одну группу
+const maxGroupCommit = 512
+
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch m := SyncMode(s); m {
+	case SyncAlways, SyncInterval, SyncNone:
+		return m, nil
+	case "":
+		return SyncAlways, nil
+	default:
+		return "", fmt.Errorf("unknown sync mode %q", s)
+	}
+}
+
+type writeRequest struct {
+	records []URLInFile
+	done    chan error
+}
+
+// startWriter открывает файл данных и запускает горутину, которая пишет в него группами:
+// все запросы, накопившиеся за время предыдущей записи, пишутся вместе и делят один fsync
+func (f *FileStorage) startWriter() error {
+	file, err := os.OpenFile(f.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.needHeader = info.Size() == 0
+	f.writes = make(chan writeRequest, maxGroupCommit)
+	f.writerDone = make(chan struct{})
+
+	go f.runWriter()
+	return nil
+}
+
+func (f *FileStorage) runWriter() {
+	defer close(f.writerDone)
+
+	var tick <-chan time.Time
+	if f.opts.Sync == SyncInterval {
+		ticker := time.NewTicker(f.opts.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	w := bufio.NewWriter(dataFile{f})
+	group := make([]writeRequest, 0, maxGroupCommit)
+
+	for {
+		select {
+		case req, ok := <-f.writes:
+			if !ok {
+				f.closeFile()
+				return
+			}
+			group = f.collectGroup(append(group[:0], req))
+			size, err := f.writeGroup(w, group)
+			for _, r := range group {
+				r.done <- err
+			}
+			if err != nil {
+				// отбрасываем недописанную группу, чтобы следующие записи
+				// не легли в файл после её обрывка
+				w.Reset(dataFile{f})
+				f.resetFile(size)
+			}
+		case <-tick:
+			f.sync()
+		}
+	}
+}
+
+// dataFile пишет в текущий файл данных, который resetFile может подменить.
+// Используется под fileMu.
+type dataFile struct {
+	f *FileStorage
+}
+
+func (d dataFile) Write(p []byte) (int, error) {
+	return d.f.file.Write(p)
+}
+
+// collectGroup добирает в группу запросы, уже ожидающие в очереди
+func (f *FileStorage) collectGroup(group []writeRequest) []writeRequest {
+	for len(group) < maxGroupCommit {
+		select {
+		case req, ok := <-f.writes:
+			if !ok {
+				return group
+			}
+			group = append(group, req)
+		default:
+			return group
+		}
+	}
+	return group
+}
+
+// writeGroup пишет группу в файл и возвращает размер файла до её записи,
+// до которого файл откатывается при ошибке. -1 — размер узнать не удалось.
+func (f *FileStorage) writeGroup(w *bufio.Writer, group []writeRequest) (int64, error) {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	info, err := f.file.Stat()
+	if err != nil {
+		return -1, err
+	}
+	size := info.Size()
+
+	if f.needHeader {
+		if err := f.codec.writeHeader(w); err != nil {
+			return size, err
+		}
+		f.needHeader = false
+	}
+
+	records := 0
+	for _, req := range group {
+		for _, r := range req.records {
+			if err := f.writeRecord(w, r); err != nil {
+				return size, err
+			}
+			records++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return size, err
+	}
+	if f.opts.Sync == SyncAlways {
+		if err := f.file.Sync(); err != nil {
+			return size, err
+		}
+	}
+
+	f.tailRecords += records
+	f.requestCompaction()
+	return size, nil
+}
+
+// resetFile отрезает от файла данных недописанную группу и переоткрывает его.
+// Если файл успели сжать, он уже короче size и обрывка в нём нет.
+func (f *FileStorage) resetFile(size int64) {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	file, err := os.OpenFile(f.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		f.Log.Error("Ошибка переоткрытия файла бекапа", zap.Error(err))
+		file = f.file
+	}
+	if info, err := file.Stat(); err == nil && size >= 0 && info.Size() > size {
+		if err := file.Truncate(size); err != nil {
+			f.Log.Error("Ошибка отката недописанной группы", zap.Error(err))
+		}
+	}
+	if info, err := file.Stat(); err == nil {
+		f.needHeader = info.Size() == 0
+	}
+	if file != f.file {
+		_ = f.file.Close()
+		f.file = file
+	}
+}
+
+func (f *FileStorage) sync() {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.Log.Error("Ошибка сброса файла на диск", zap.Error(err))
+	}
+}
+
+func (f *FileStorage) closeFile() {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.Log.Error("Ошибка сброса файла на диск", zap.Error(err))
+	}
+	if err := f.file.Close(); err != nil {
+		f.Log.Error("Ошибка закрытия файла", zap.Error(err))
+	}
+}
+
+// append отправляет записи писателю и ждёт, пока они будут записаны согласно режиму Sync
+func (f *FileStorage) append(records ...URLInFile) error {
+	f.closeMu.RLock()
+	defer f.closeMu.RUnlock()
+	if f.closed {
+		return entity.ErrStorageClosed
+	}
+
+	done := make(chan error, 1)
+	f.writes <- writeRequest{records: records, done: done}
+	return <-done
+}
+
+// Close дописывает ожидающие записи, сбрасывает файл на диск и закрывает его
+func (f *FileStorage) Close() error {
+	f.closeMu.Lock()
+	if f.closed {
+		f.closeMu.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.writes)
+	f.closeMu.Unlock()
+
+	<-f.writerDone
+	return nil
+}
@@ -2,28 +2,124 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"hash/maphash"
+	"net/url"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Taboon/urlshortner/internal/entity"
 )
 
+// shardCount количество шардов ссылок и пользователей, степень двойки
+const shardCount = 64
+
+// InternalStorage хранилище в памяти. Ссылки разложены по шардам по хешу короткого ID,
+// списки ссылок пользователей — по шардам по ID пользователя, у каждого шарда своя блокировка.
+// Редирект блокирует на чтение один шард, сокращение по очереди один шард ссылок и один
+// шард пользователей, никогда не удерживая обе блокировки сразу.
 type InternalStorage struct {
-	Users    map[int]UserURLs
 	Log      *zap.Logger
-	mu       sync.Mutex
 	Backuper *FileStorage
+	// MaxURLLength максимальная длина нового URL в байтах, 0 — без ограничения.
+	// Базы хранят URL любой длины, а память процесса не бесконечна.
+	MaxURLLength int
+	lastUserID   atomic.Int64 // последний выданный ID пользователя, восстанавливается из бекапа
+
+	seed   maphash.Seed
+	urls   [shardCount]urlShard
+	owners [shardCount]userShard
+}
+
+// urlShard ссылки с ID, попавшими в шард: ID → владелец и данные ссылки
+type urlShard struct {
+	mu  sync.RWMutex
+	ids map[string]urlEntry
+}
+
+type urlEntry struct {
+	userID int
+	data   URLData
+}
+
+// userShard ссылки пользователей, попавших в шард: порядок добавления и индекс (пользователь, URL) → ID
+type userShard struct {
+	mu   sync.RWMutex
+	ids  map[int][]string
+	urls map[userURL]string
+}
+
+type userURL struct {
+	userID int
+	url    string
 }
 
-var _ Repository = (*InternalStorage)(nil)
+var _ Store = (*InternalStorage)(nil)
+var _ DeleteJournal = (*InternalStorage)(nil)
+var _ Exporter = (*InternalStorage)(nil)
+var _ Importer = (*InternalStorage)(nil)
+
+// DefaultMaxURLLength ограничение длины URL в памяти по умолчанию
+const DefaultMaxURLLength = 64 << 10
+
+func init() {
+	Register("memory", func(_ context.Context, dsn string, _ Options, l *zap.Logger) (Store, error) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		maxLen, err := ParseMaxURLLength(u.Query())
+		if err != nil {
+			return nil, err
+		}
+		l.Info("Используем память приложения для хранения")
+		is := NewMemoryStorage(l)
+		is.MaxURLLength = maxLen
+		return is, nil
+	})
+	Register("file", OpenFileStorage)
+}
+
+// ParseMaxURLLength читает max_url_length из параметров DSN хранилища в памяти
+func ParseMaxURLLength(q url.Values) (int, error) {
+	v := q.Get("max_url_length")
+	if v == "" {
+		return DefaultMaxURLLength, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("max_url_length: invalid value %q", v)
+	}
+	return n, nil
+}
 
 func NewMemoryStorage(logger *zap.Logger) *InternalStorage {
-	return &InternalStorage{
-		Users: make(map[int]UserURLs),
-		Log:   logger,
-		mu:    sync.Mutex{},
+	is := &InternalStorage{
+		Log:          logger,
+		MaxURLLength: DefaultMaxURLLength,
+		seed:         maphash.MakeSeed(),
+	}
+	for i := range is.urls {
+		is.urls[i].ids = make(map[string]urlEntry)
 	}
+	for i := range is.owners {
+		is.owners[i].ids = make(map[int][]string)
+		is.owners[i].urls = make(map[userURL]string)
+	}
+	return is
+}
+
+func (is *InternalStorage) urlShard(id string) *urlShard {
+	return &is.urls[maphash.String(is.seed, id)&(shardCount-1)]
+}
+
+func (is *InternalStorage) userShard(userID int) *userShard {
+	return &is.owners[uint(userID)&(shardCount-1)]
 }
 
 func (is *InternalStorage) Ping(_ context.Context) error {
@@ -31,21 +127,81 @@ func (is *InternalStorage) Ping(_ context.Context) error {
 }
 
 func (is *InternalStorage) GetURLsByUser(_ context.Context, id int) (UserURLs, error) {
-	return is.Users[id], nil
+	us := is.userShard(id)
+	us.mu.RLock()
+	ids, ok := us.ids[id]
+	ids = ids[:len(ids):len(ids)]
+	us.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	urls := make(UserURLs, 0, len(ids))
+	for _, v := range ids {
+		if e, ok := is.get(v); ok {
+			urls = append(urls, e.data)
+		}
+	}
+	return urls, nil
+}
+
+func (is *InternalStorage) OwnedIDs(_ context.Context, userID int, ids []string) ([]string, error) {
+	owned := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := is.get(id); ok && e.userID == userID {
+			owned = append(owned, id)
+		}
+	}
+	return owned, nil
 }
 
 func (is *InternalStorage) GetNewUser(_ context.Context) (int, error) {
-	return len(is.Users) + 1, nil
+	id := int(is.lastUserID.Add(1))
+
+	if is.Backuper != nil {
+		// сохраняем выданный ID, чтобы после перезапуска он не достался другому пользователю
+		err := is.Backuper.Set(URLInFile{UserID: id, Op: opUser})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// raiseLastUserID сдвигает счётчик пользователей вперёд, но не назад
+func (is *InternalStorage) raiseLastUserID(id int) int {
+	for {
+		cur := is.lastUserID.Load()
+		if int64(id) <= cur {
+			return int(cur)
+		}
+		if is.lastUserID.CompareAndSwap(cur, int64(id)) {
+			return id
+		}
+	}
 }
 
 func (is *InternalStorage) WriteBatchURL(ctx context.Context, b *ReqBatchURLs) (*ReqBatchURLs, error) {
 	urlData := URLData{}
 	for i, v := range *b {
+		// если данные не валидны, пропускаем текущую итерацию
+		if v.Err != nil {
+			continue
+		}
 		urlData.ID = v.ID
 		urlData.URL = v.URL
+		// пачка пишется построчно: занятый ID отмечается в строке, остальные строки сохраняются
 		err := is.AddURL(ctx, urlData)
+		if errors.Is(err, entity.ErrURLTooLong) || errors.Is(err, entity.ErrIDExist) {
+			(*b)[i].Err = err
+			continue
+		}
 		if err != nil {
 			(*b)[i].Err = entity.ErrURLExist
+			var exist *URLExistError
+			if errors.As(err, &exist) {
+				(*b)[i].ID = exist.ID
+			}
 		}
 	}
 	return b, nil
@@ -66,18 +222,19 @@ func (is *InternalStorage) CheckBatchURL(ctx context.Context, urls *ReqBatchURLs
 
 func (is *InternalStorage) AddURL(ctx context.Context, data URLData) error {
 	is.Log.Debug("Сохраняем URL")
-	is.mu.Lock()
-	defer is.mu.Unlock()
-
-	id := ctx.Value(UserID).(int)
+	id, ok := ctx.Value(UserID).(int)
+	if !ok {
+		return entity.ErrUnknownUser
+	}
 
-	urls, ok := is.Users[id]
-	if ok {
-		is.Users[id] = append(urls, data)
-	} else {
-		is.Users[id] = append(UserURLs{}, data)
+	if is.MaxURLLength > 0 && len(data.URL) > is.MaxURLLength {
+		return fmt.Errorf("%w: %d bytes, limit %d", entity.ErrURLTooLong, len(data.URL), is.MaxURLLength)
+	}
+	if err := is.addUnique(id, data); err != nil {
+		return err
 	}
 
+	// пишем в бекап без блокировки хранилища, чтобы параллельные записи делили один fsync
 	if is.Backuper != nil {
 		is.Log.Debug("Пишем в файл бекапа")
 		err := is.Backuper.Set(URLInFile{
@@ -86,6 +243,8 @@ func (is *InternalStorage) AddURL(ctx context.Context, data URLData) error {
 			UserID: id,
 		})
 		if err != nil {
+			// не сохранённая в бекап ссылка пропала бы после перезапуска
+			is.remove(id, data)
 			return err
 		}
 	}
@@ -94,31 +253,307 @@ func (is *InternalStorage) AddURL(ctx context.Context, data URLData) error {
 
 func (is *InternalStorage) CheckID(_ context.Context, id string) (URLData, bool, error) {
 	is.Log.Debug("Проверяем ID", zap.String("ID", id))
-	fmt.Println(is.Users)
-	for _, u := range is.Users {
-		for _, v := range u {
-			if v.ID == id {
-				return v, true, nil
-			}
-		}
-	}
-	return URLData{}, false, nil
+	e, ok := is.get(id)
+	return e.data, ok, nil
 }
 
 func (is *InternalStorage) CheckURL(ctx context.Context, url string) (URLData, bool, error) {
 	is.Log.Debug("Проверяем URL", zap.String("url", url))
-	userid := ctx.Value(UserID).(int)
-	user, ok := is.Users[userid]
-	if ok {
-		for _, v := range user {
-			if v.URL == url {
-				return v, true, nil
-			}
+	userid, _ := ctx.Value(UserID).(int)
+
+	us := is.userShard(userid)
+	us.mu.RLock()
+	id, ok := us.urls[userURL{userID: userid, url: url}]
+	us.mu.RUnlock()
+	if !ok {
+		return URLData{}, false, nil
+	}
+	e, ok := is.get(id)
+	return e.data, ok, nil
+}
+
+func (is *InternalStorage) get(id string) (urlEntry, bool) {
+	s := is.urlShard(id)
+	s.mu.RLock()
+	e, ok := s.ids[id]
+	s.mu.RUnlock()
+	return e, ok
+}
+
+// addUnique добавляет ссылку, если пользователь ещё не сокращал этот URL.
+// URL резервируется в шарде пользователя до записи ссылки, поэтому из
+// параллельных вызовов с одним URL успешен только первый.
+func (is *InternalStorage) addUnique(userID int, data URLData) error {
+	us := is.userShard(userID)
+	key := userURL{userID: userID, url: data.URL}
+	us.mu.Lock()
+	if id, ok := us.urls[key]; ok {
+		us.mu.Unlock()
+		return &URLExistError{ID: id}
+	}
+	us.urls[key] = data.ID
+	us.mu.Unlock()
+
+	s := is.urlShard(data.ID)
+	s.mu.Lock()
+	if _, ok := s.ids[data.ID]; ok {
+		s.mu.Unlock()
+		us.mu.Lock()
+		delete(us.urls, key)
+		us.mu.Unlock()
+		return fmt.Errorf("%w: %s", entity.ErrIDExist, data.ID)
+	}
+	s.ids[data.ID] = urlEntry{userID: userID, data: data}
+	s.mu.Unlock()
+
+	us.mu.Lock()
+	us.ids[userID] = append(us.ids[userID], data.ID)
+	us.mu.Unlock()
+	return nil
+}
+
+// remove откатывает addUnique
+func (is *InternalStorage) remove(userID int, data URLData) {
+	s := is.urlShard(data.ID)
+	s.mu.Lock()
+	delete(s.ids, data.ID)
+	s.mu.Unlock()
+
+	us := is.userShard(userID)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.urls, userURL{userID: userID, url: data.URL})
+	ids := us.ids[userID]
+	for i, id := range ids {
+		if id == data.ID {
+			// новый массив: GetURLsByUser читает прежний без блокировки
+			us.ids[userID] = append(ids[:i:i], ids[i+1:]...)
+			break
 		}
 	}
-	return URLData{}, false, nil
 }
 
-func (is *InternalStorage) RemoveURL(_ context.Context, _ []URLData) error {
+// add добавляет ссылку в шард ссылок, затем в шард пользователя.
+// Возвращает false, если ID уже занят.
+func (is *InternalStorage) add(userID int, data URLData) bool {
+	s := is.urlShard(data.ID)
+	s.mu.Lock()
+	if _, ok := s.ids[data.ID]; ok {
+		s.mu.Unlock()
+		return false
+	}
+	s.ids[data.ID] = urlEntry{userID: userID, data: data}
+	s.mu.Unlock()
+
+	us := is.userShard(userID)
+	us.mu.Lock()
+	us.ids[userID] = append(us.ids[userID], data.ID)
+	key := userURL{userID: userID, url: data.URL}
+	if _, ok := us.urls[key]; !ok {
+		us.urls[key] = data.ID
+	}
+	us.mu.Unlock()
+	return true
+}
+
+// markDeleted помечает удалённой ссылку пользователя. Возвращает false, если
+// ID не найден или принадлежит другому пользователю.
+func (is *InternalStorage) markDeleted(userID int, id string) bool {
+	s := is.urlShard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.ids[id]
+	if !ok || e.userID != userID {
+		return false
+	}
+	e.data.Deleted = true
+	s.ids[id] = e
+	return true
+}
+
+// each вызывает fn для всех ссылок, по очереди блокируя шарды на чтение
+func (is *InternalStorage) each(fn func(userID int, data URLData)) {
+	for i := range is.urls {
+		s := &is.urls[i]
+		s.mu.RLock()
+		for _, e := range s.ids {
+			fn(e.userID, e.data)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+func (is *InternalStorage) RemoveURL(ctx context.Context, data []URLData) error {
+	userID, ok := ctx.Value(UserID).(int)
+	if !ok || userID == 0 {
+		return entity.ErrUnknownUser
+	}
+
+	// помечаем удалёнными только URL пользователя из контекста
+	removed := make([]URLData, 0, len(data))
+	for _, v := range data {
+		if is.markDeleted(userID, v.ID) {
+			removed = append(removed, v)
+		}
+	}
+
+	if len(removed) != len(data) {
+		is.Log.Info("Часть URL не принадлежит пользователю и не удалена",
+			zap.Int("user", userID), zap.Int("requested", len(data)), zap.Int("removed", len(removed)))
+	}
+
+	if is.Backuper != nil && len(removed) > 0 {
+		is.Log.Debug("Пишем в файл бекапа удаление")
+		return is.Backuper.RemoveURL(ctx, userID, removed)
+	}
+	return nil
+}
+
+// Close закрывает файл бекапа
+func (is *InternalStorage) Close() error {
+	if is.Backuper == nil {
+		return nil
+	}
+	return is.Backuper.Close()
+}
+
+// AppendDeletes сохраняет задачи на удаление в файл бекапа, если он используется
+func (is *InternalStorage) AppendDeletes(ctx context.Context, tasks []DeleteTask) error {
+	if is.Backuper == nil {
+		return nil
+	}
+	return is.Backuper.AppendDeletes(ctx, tasks)
+}
+
+func (is *InternalStorage) AckDeletes(ctx context.Context, tasks []DeleteTask) error {
+	if is.Backuper == nil {
+		return nil
+	}
+	return is.Backuper.AckDeletes(ctx, tasks)
+}
+
+func (is *InternalStorage) PendingDeletes(ctx context.Context) ([]DeleteTask, error) {
+	if is.Backuper == nil {
+		return nil, nil
+	}
+	return is.Backuper.PendingDeletes(ctx)
+}
+
+func (is *InternalStorage) Stats(_ context.Context) (Stats, error) {
+	stats := Stats{LastUserID: int(is.lastUserID.Load())}
+	is.each(func(_ int, data URLData) {
+		stats.URLs++
+		if data.Deleted {
+			stats.Deleted++
+		}
+	})
+	return stats, nil
+}
+
+// ExportURLs собирает ссылки с ID больше after. Шарды не упорядочены,
+// поэтому каждая страница требует полного прохода по хранилищу.
+func (is *InternalStorage) ExportURLs(_ context.Context, after string, limit int) ([]Record, error) {
+	var records []Record
+	is.each(func(userID int, data URLData) {
+		if data.ID > after {
+			records = append(records, Record{ID: data.ID, URL: data.URL, UserID: userID, Deleted: data.Deleted})
+		}
+	})
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+func (is *InternalStorage) ImportUsers(_ context.Context, lastUserID int) error {
+	id := is.raiseLastUserID(lastUserID)
+
+	if is.Backuper != nil {
+		return is.Backuper.Set(URLInFile{UserID: id, Op: opUser})
+	}
 	return nil
 }
+
+func (is *InternalStorage) ImportURLs(_ context.Context, records []Record) error {
+	backup := make([]URLInFile, 0, len(records))
+	for _, r := range records {
+		data := URLInFile{ID: r.ID, URL: r.URL, UserID: r.UserID, Deleted: r.Deleted}
+		if _, ok := is.get(r.ID); ok && !r.Deleted {
+			continue
+		}
+		is.restore(data)
+		backup = append(backup, data)
+	}
+
+	if is.Backuper != nil && len(backup) > 0 {
+		return is.Backuper.append(backup...)
+	}
+	return nil
+}
+
+// restore применяет запись из файла бекапа к хранилищу. После сбоя между записью
+// снимка и очисткой хвоста записи в них пересекаются, поэтому повторно добавленные ID пропускаем.
+func (is *InternalStorage) restore(data URLInFile) {
+	is.raiseLastUserID(data.UserID)
+
+	switch data.Op {
+	case opDelete:
+		is.markDeleted(data.UserID, data.ID)
+	case opUser:
+	default:
+		if !is.add(data.UserID, URLData{ID: data.ID, URL: data.URL, Deleted: data.Deleted}) && data.Deleted {
+			is.markDeleted(data.UserID, data.ID)
+		}
+	}
+}
+
+// snapshot возвращает текущее состояние в виде записей файла бекапа
+func (is *InternalStorage) snapshot() []URLInFile {
+	records := []URLInFile{{UserID: int(is.lastUserID.Load()), Op: opUser}}
+	is.each(func(userID int, data URLData) {
+		records = append(records, URLInFile{ID: data.ID, URL: data.URL, UserID: userID, Deleted: data.Deleted})
+	})
+	return records
+}
+
+// Compact сжимает файл бекапа до снимка текущего состояния
+func (is *InternalStorage) Compact() error {
+	if is.Backuper == nil {
+		return nil
+	}
+	return is.Backuper.Compact(is.snapshot)
+}
+
+// StartCompactor запускает фоновое сжатие файла бекапа по таймеру
+// и при превышении размера хвоста. Останавливается при отмене ctx.
+func (is *InternalStorage) StartCompactor(ctx context.Context) {
+	if is.Backuper == nil {
+		return
+	}
+
+	go func() {
+		var tick <-chan time.Time
+		if is.Backuper.opts.CompactInterval > 0 {
+			ticker := time.NewTicker(is.Backuper.opts.CompactInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case <-is.Backuper.compactCh:
+			}
+			if err := is.Compact(); err != nil {
+				is.Log.Error("Ошибка сжатия файла бекапа", zap.Error(err))
+			}
+		}
+	}()
+}
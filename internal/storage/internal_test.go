@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestInternalStorageIndexes(t *testing.T) {
+	is := NewMemoryStorage(zap.NewNop())
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	require.NoError(t, is.AddURL(userContext(2), URLData{ID: "BBBBbbbb", URL: "http://ya.ru"}))
+	assert.ErrorIs(t, is.AddURL(userContext(2), URLData{ID: "AAAAaaaa", URL: "http://other.ru"}), entity.ErrIDExist)
+
+	data, ok, err := is.CheckID(context.Background(), "BBBBbbbb")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, URLData{ID: "BBBBbbbb", URL: "http://ya.ru"}, data)
+
+	data, ok, err = is.CheckURL(userContext(1), "http://ya.ru")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "AAAAaaaa", data.ID)
+
+	// чужой ID не удаляется
+	require.NoError(t, is.RemoveURL(userContext(1), []URLData{{ID: "AAAAaaaa"}, {ID: "BBBBbbbb"}}))
+	data, _, _ = is.CheckID(context.Background(), "AAAAaaaa")
+	assert.True(t, data.Deleted)
+	data, _, _ = is.CheckID(context.Background(), "BBBBbbbb")
+	assert.False(t, data.Deleted)
+}
+
+func TestInternalStorageAddURLBackupError(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, "file://"+filepath.Join(t.TempDir(), "db.json"), zap.NewNop())
+	require.NoError(t, err)
+	is := s.(*InternalStorage)
+	defer is.Close()
+
+	assert.ErrorIs(t, is.AddURL(ctx, URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}), entity.ErrUnknownUser)
+
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	// бекап недоступен: ссылка не должна остаться только в памяти
+	require.NoError(t, is.Backuper.Close())
+	assert.ErrorIs(t, is.AddURL(userContext(1), URLData{ID: "BBBBbbbb", URL: "http://other.ru"}), entity.ErrStorageClosed)
+
+	_, ok, err := is.CheckID(ctx, "BBBBbbbb")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	_, ok, err = is.CheckURL(userContext(1), "http://other.ru")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	urls, err := is.GetURLsByUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, UserURLs{{ID: "AAAAaaaa", URL: "http://ya.ru"}}, urls)
+}
+
+// TestInternalStorageConcurrent запускается с -race: редиректы идут параллельно с записью и удалением
+func TestInternalStorageURLLength(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, "memory://?max_url_length=100", zap.NewNop())
+	require.NoError(t, err)
+	is := s.(*InternalStorage)
+	assert.Equal(t, 100, is.MaxURLLength)
+
+	long := "http://ya.ru/" + strings.Repeat("a", 100)
+	assert.ErrorIs(t, is.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: long}), entity.ErrURLTooLong)
+
+	batch := ReqBatchURLs{{ID: "AAAAaaaa", URL: long}, {ID: "BBBBbbbb", URL: "http://ya.ru"}}
+	_, err = is.WriteBatchURL(userContext(1), &batch)
+	require.NoError(t, err)
+	assert.ErrorIs(t, batch[0].Err, entity.ErrURLTooLong)
+	assert.NoError(t, batch[1].Err)
+
+	_, err = Open(ctx, "memory://?max_url_length=-1", zap.NewNop())
+	assert.Error(t, err)
+
+	// без ограничения и в bolt принимаются URL любой длины
+	huge := "http://ya.ru/" + strings.Repeat("a", 1<<20)
+	unlimited := NewMemoryStorage(zap.NewNop())
+	unlimited.MaxURLLength = 0
+	b, err := Open(ctx, "bolt://"+filepath.Join(t.TempDir(), "urls.db"), zap.NewNop())
+	require.NoError(t, err)
+	defer b.Close()
+	for _, s := range []Store{unlimited, b} {
+		require.NoError(t, s.AddURL(userContext(1), URLData{ID: "CCCCcccc", URL: huge}))
+		data, ok, err := s.CheckURL(userContext(1), huge)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "CCCCcccc", data.ID)
+	}
+}
+
+func TestInternalStorageConcurrent(t *testing.T) {
+	is := NewMemoryStorage(zap.NewNop())
+	require.NoError(t, is.AddURL(userContext(1), URLData{ID: "hot", URL: "http://hot.ru"}))
+
+	var wg sync.WaitGroup
+	for w := 1; w <= 4; w++ {
+		wg.Add(2)
+		go func(user int) {
+			defer wg.Done()
+			ctx := userContext(user)
+			for i := 0; i < 200; i++ {
+				id := fmt.Sprintf("%d-%d", user, i)
+				assert.NoError(t, is.AddURL(ctx, URLData{ID: id, URL: "http://" + id}))
+				if i%10 == 0 {
+					assert.NoError(t, is.RemoveURL(ctx, []URLData{{ID: id}}))
+				}
+			}
+		}(w)
+		go func(user int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_, ok, err := is.CheckID(context.Background(), "hot")
+				assert.NoError(t, err)
+				assert.True(t, ok)
+				_, _, err = is.CheckURL(userContext(user), "http://hot.ru")
+				assert.NoError(t, err)
+				urls, err := is.GetURLsByUser(context.Background(), user)
+				assert.NoError(t, err)
+				for _, v := range urls {
+					_ = v.Deleted
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 2; w <= 4; w++ {
+		urls, err := is.GetURLsByUser(context.Background(), w)
+		require.NoError(t, err)
+		assert.Len(t, urls, 200)
+	}
+}
+
+func newBenchStorage(b *testing.B, n int) (*InternalStorage, []string) {
+	is := NewMemoryStorage(zap.NewNop())
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("id%06d", i)
+		require.NoError(b, is.AddURL(userContext(i%100+1), URLData{ID: ids[i], URL: "http://" + ids[i]}))
+	}
+	return is, ids
+}
+
+// BenchmarkInternalStorageCheckID параллельные редиректы GET /{id}
+func BenchmarkInternalStorageCheckID(b *testing.B) {
+	is, ids := newBenchStorage(b, 100000)
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, _, _ = is.CheckID(ctx, ids[i%len(ids)])
+			i += 7919
+		}
+	})
+}
+
+// BenchmarkInternalStorageAddURL параллельные сокращения POST /
+func BenchmarkInternalStorageAddURL(b *testing.B) {
+	is := NewMemoryStorage(zap.NewNop())
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := userContext(int(next.Add(1)))
+		for pb.Next() {
+			id := strconv.FormatInt(next.Add(1), 36)
+			_ = is.AddURL(ctx, URLData{ID: id, URL: "http://" + id})
+		}
+	})
+}
+
+// BenchmarkInternalStorageMixed редиректы вперемешку с сокращениями, одна запись на десять чтений
+func BenchmarkInternalStorageMixed(b *testing.B) {
+	is, ids := newBenchStorage(b, 100000)
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := userContext(int(next.Add(1)))
+		i := 0
+		for pb.Next() {
+			if i%10 == 0 {
+				id := "new" + strconv.FormatInt(next.Add(1), 36)
+				_ = is.AddURL(ctx, URLData{ID: id, URL: "http://" + id})
+			} else {
+				_, _, _ = is.CheckID(ctx, ids[(i*7919)%len(ids)])
+			}
+			i++
+		}
+	})
+}
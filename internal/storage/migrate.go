@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Taboon/urlshortner/migration"
+	"github.com/pressly/goose/v3"
+	"go.uber.org/zap"
+)
+
+// MigrateOptions настройки применения миграций схемы
+type MigrateOptions struct {
+	// Manual не применять миграции при открытии SQL-хранилища. Схему тогда обновляют
+	// командой shortener migrate up, а при старте только проверяется, что все миграции применены.
+	Manual bool
+	// LockTimeout сколько экземпляр ждёт, пока другой закончит миграции Postgres.
+	// Ноль — DefaultMigrationLockTimeout.
+	LockTimeout time.Duration
+}
+
+// Migrator применяет встроенные миграции к базе хранилища
+type Migrator struct {
+	db       *sql.DB
+	ownDB    bool
+	provider *goose.Provider
+	opts     MigrateOptions
+	log      *zap.Logger
+}
+
+// NewMigrator открывает отдельное соединение с базой по DSN хранилища.
+// Поддерживаются postgres, mysql и sqlite, остальным хранилищам схема не нужна.
+// В Postgres миграции нескольких экземпляров сериализуются advisory lock.
+func NewMigrator(dsn string, opts MigrateOptions, l *zap.Logger) (*Migrator, error) {
+	driver, conn, dialect, dir, err := migrationTarget(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, conn)
+	if err != nil {
+		return nil, err
+	}
+	var providerOpts []goose.ProviderOption
+	if dialect == goose.DialectPostgres {
+		timeout := opts.LockTimeout
+		if timeout <= 0 {
+			timeout = DefaultMigrationLockTimeout
+		}
+		providerOpts = append(providerOpts, goose.WithSessionLocker(&pgMigrationLock{timeout: timeout, log: l}))
+	}
+	m, err := newMigrator(db, dialect, dir, opts, l, providerOpts...)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	m.ownDB = true
+	return m, nil
+}
+
+// newMigrator применяет миграции из подкаталога dir через уже открытое соединение хранилища
+func newMigrator(db *sql.DB, dialect goose.Dialect, dir string, opts MigrateOptions, l *zap.Logger, providerOpts ...goose.ProviderOption) (*Migrator, error) {
+	fsys, err := fs.Sub(migration.FS, dir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := goose.NewProvider(dialect, db, fsys, providerOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, provider: p, opts: opts, log: l}, nil
+}
+
+// migrationTarget драйвер database/sql, строка подключения, диалект и каталог миграций для DSN
+func migrationTarget(dsn string) (driver, conn string, dialect goose.Dialect, dir string, err error) {
+	scheme := "postgres"
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", "", "", "", err
+		}
+		scheme = u.Scheme
+	}
+
+	switch scheme {
+	case "postgres", "postgresql":
+		// реплики и прочие параметры хранилища миграциям не нужны
+		dsn, _, err := parsePgOptions(dsn)
+		if err != nil {
+			return "", "", "", "", err
+		}
+		return "pgx", dsn, goose.DialectPostgres, ".", nil
+	case "mysql":
+		conf, err := mysqlConfig(dsn)
+		if err != nil {
+			return "", "", "", "", err
+		}
+		return "mysql", conf.FormatDSN(), goose.DialectMySQL, "mysql", nil
+	case "sqlite":
+		path, _, err := dsnPath(dsn, "sqlite")
+		if err != nil {
+			return "", "", "", "", err
+		}
+		return "sqlite3", sqliteConn(path), goose.DialectSQLite3, "sqlite", nil
+	default:
+		return "", "", "", "", fmt.Errorf("storage scheme %q has no schema migrations", scheme)
+	}
+}
+
+// Up применяет все новые миграции
+func (m *Migrator) Up(ctx context.Context) ([]*goose.MigrationResult, error) {
+	res, err := m.provider.Up(ctx)
+	m.logResults(res...)
+	return res, err
+}
+
+// Down откатывает последнюю применённую миграцию
+func (m *Migrator) Down(ctx context.Context) (*goose.MigrationResult, error) {
+	res, err := m.provider.Down(ctx)
+	if res != nil {
+		m.logResults(res)
+	}
+	return res, err
+}
+
+// Redo откатывает и заново применяет последнюю миграцию
+func (m *Migrator) Redo(ctx context.Context) ([]*goose.MigrationResult, error) {
+	down, err := m.Down(ctx)
+	if err != nil {
+		return nil, err
+	}
+	up, err := m.provider.ApplyVersion(ctx, down.Source.Version, true)
+	if err != nil {
+		return []*goose.MigrationResult{down}, err
+	}
+	m.logResults(up)
+	return []*goose.MigrationResult{down, up}, nil
+}
+
+// Status состояние всех миграций по возрастанию версии
+func (m *Migrator) Status(ctx context.Context) ([]*goose.MigrationStatus, error) {
+	return m.provider.Status(ctx)
+}
+
+// Pending число ещё не применённых миграций
+func (m *Migrator) Pending(ctx context.Context) (int, error) {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, s := range status {
+		if s.State == goose.StatePending {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Close закрывает соединение, если мигратор открывал его сам
+func (m *Migrator) Close() error {
+	if !m.ownDB {
+		return nil
+	}
+	return m.db.Close()
+}
+
+func (m *Migrator) logResults(res ...*goose.MigrationResult) {
+	for _, r := range res {
+		if r.Error != nil {
+			m.log.Error("Ошибка миграции", zap.String("migration", r.String()), zap.Error(r.Error))
+			continue
+		}
+		m.log.Info("Миграция выполнена", zap.String("migration", r.String()))
+	}
+}
+
+// autoMigrate применяет миграции при открытии хранилища. При ручных миграциях
+// хранилище открывается и со старой схемой, но об этом пишем в лог.
+func autoMigrate(ctx context.Context, m *Migrator) error {
+	if !m.opts.Manual {
+		res, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			// сюда же попадают экземпляры, дождавшиеся чужих миграций
+			version, err := m.provider.GetDBVersion(ctx)
+			if err != nil {
+				return err
+			}
+			m.log.Info("Схема базы актуальна", zap.Int64("version", version))
+		}
+		return nil
+	}
+
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		m.log.Warn("Схема базы устарела, выполните shortener migrate up", zap.Int("pending", pending))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/Taboon/urlshortner/migration"
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEmbeddedMigrationsHaveDown(t *testing.T) {
+	files, err := fs.Glob(migration.FS, "*.sql")
+	require.NoError(t, err)
+	for _, dir := range []string{"sqlite", "mysql"} {
+		sub, err := fs.Glob(migration.FS, dir+"/*.sql")
+		require.NoError(t, err)
+		files = append(files, sub...)
+	}
+	require.NotEmpty(t, files)
+
+	for _, f := range files {
+		data, err := fs.ReadFile(migration.FS, f)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "-- +goose Down", f)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "urls.db")
+	m, err := NewMigrator(dsn, MigrateOptions{}, zap.NewNop())
+	require.NoError(t, err)
+	defer m.Close()
+
+	total, err := m.Pending(ctx)
+	require.NoError(t, err)
+	require.Greater(t, total, 0)
+
+	res, err := m.Up(ctx)
+	require.NoError(t, err)
+	assert.Len(t, res, total)
+	pending, err := m.Pending(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+
+	res, err = m.Redo(ctx)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.Equal(t, "down", res[0].Direction)
+	assert.Equal(t, "up", res[1].Direction)
+	assert.Equal(t, res[0].Source.Version, res[1].Source.Version)
+
+	// все миграции откатываются до пустой базы и применяются заново
+	for i := 0; i < total; i++ {
+		_, err := m.Down(ctx)
+		require.NoError(t, err)
+	}
+	_, err = m.Down(ctx)
+	require.ErrorIs(t, err, goose.ErrNoNextVersion)
+
+	status, err := m.Status(ctx)
+	require.NoError(t, err)
+	for _, s := range status {
+		assert.Equal(t, goose.StatePending, s.State, s.Source.Path)
+	}
+
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	// хранилище открывается на уже мигрированной базе, в том числе без автомиграций
+	s, err := OpenWith(ctx, dsn, Options{Migrate: MigrateOptions{Manual: true}}, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	_, err = NewMigrator("bolt://"+filepath.Join(t.TempDir(), "db.bolt"), MigrateOptions{}, zap.NewNop())
+	assert.ErrorContains(t, err, "no schema migrations")
+}
+
+func TestMigrationKeepsDuplicateURLs(t *testing.T) {
+	ctx := context.Background()
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "urls.db")
+	m, err := NewMigrator(dsn, MigrateOptions{}, zap.NewNop())
+	require.NoError(t, err)
+	defer m.Close()
+
+	// дубли от гонки, случившейся до уникального индекса
+	_, err = m.provider.UpTo(ctx, 20261018100000)
+	require.NoError(t, err)
+	_, err = m.db.ExecContext(ctx, `INSERT INTO users (id) VALUES (1)`)
+	require.NoError(t, err)
+	_, err = m.db.ExecContext(ctx, `INSERT INTO url (id, url, is_deleted, user_id) VALUES
+		('AAAAaaaa', 'http://ya.ru', TRUE, 1),
+		('BBBBbbbb', 'http://ya.ru', FALSE, 1),
+		('CCCCcccc', 'http://ya.ru', FALSE, 1)`)
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	s, err := Open(ctx, dsn, zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// выданные ID продолжают открываться
+	for _, id := range []string{"AAAAaaaa", "BBBBbbbb", "CCCCcccc"} {
+		data, ok, err := s.CheckID(ctx, id)
+		require.NoError(t, err)
+		require.True(t, ok, id)
+		assert.Equal(t, "http://ya.ru", data.URL)
+	}
+
+	// основной остаётся неудалённая ссылка с меньшим ID
+	data, ok, err := s.CheckURL(userContext(1), "http://ya.ru")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "BBBBbbbb", data.ID)
+
+	var exist *URLExistError
+	require.ErrorAs(t, s.AddURL(userContext(1), URLData{ID: "DDDDdddd", URL: "http://ya.ru"}), &exist)
+	assert.Equal(t, "BBBBbbbb", exist.ID)
+
+	// перенос в другое хранилище сохраняет дубли и основную ссылку
+	records, err := s.(Exporter).ExportURLs(ctx, "", 10)
+	require.NoError(t, err)
+	dst, err := Open(ctx, "sqlite://"+filepath.Join(t.TempDir(), "copy.db"), zap.NewNop())
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, dst.(Importer).ImportUsers(ctx, 1))
+	require.NoError(t, dst.(Importer).ImportURLs(ctx, records))
+
+	copied, err := dst.(Exporter).ExportURLs(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, records, copied)
+	data, ok, err = dst.CheckURL(userContext(1), "http://ya.ru")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "BBBBbbbb", data.ID)
+}
@@ -28,3 +28,27 @@ type UserURLs []URLData
 type CustomKeyContext string
 
 const UserID CustomKeyContext = "id"
+
+// DeleteTask задача на удаление короткой ссылки от имени пользователя
+type DeleteTask struct {
+	ID     string `json:"id"`
+	UserID int    `json:"user_id"`
+}
+
+// Record ссылка вместе с владельцем для переноса между хранилищами
+type Record struct {
+	ID      string
+	URL     string
+	UserID  int
+	Deleted bool
+	// Duplicate повтор URL пользователя, оставшийся от гонок до уникального индекса.
+	// Открывается по ID, но не находится по URL.
+	Duplicate bool
+}
+
+// Stats количество данных в хранилище
+type Stats struct {
+	URLs       int
+	Deleted    int
+	LastUserID int
+}
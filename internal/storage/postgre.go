@@ -2,29 +2,31 @@ package storage
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"log"
-	"os"
-	"strings"
 	"time"
 
-	"github.com/Taboon/urlshortner/internal/config"
 	"github.com/Taboon/urlshortner/internal/entity"
 	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib" // postgres driver
-	"github.com/pressly/goose"
 	"go.uber.org/zap"
 )
 
 type Postgre struct {
-	db  *pgxpool.Pool
-	Log *zap.Logger
+	db       *pgxpool.Pool
+	replicas *pgReplicas
+	Log      *zap.Logger
+
+	listenCancel context.CancelFunc
+	listenDone   chan struct{}
 }
 
-var _ Repository = (*Postgre)(nil)
+var _ Store = (*Postgre)(nil)
+var _ DeleteJournal = (*Postgre)(nil)
+var _ Exporter = (*Postgre)(nil)
+var _ Importer = (*Postgre)(nil)
 
 func NewPostgreBase(db *pgxpool.Pool, log *zap.Logger) *Postgre {
 	return &Postgre{
@@ -33,23 +35,18 @@ func NewPostgreBase(db *pgxpool.Pool, log *zap.Logger) *Postgre {
 	}
 }
 
-func Migrations(dsn string) error {
-	db, err := sql.Open("pgx", dsn)
+// Migrations применяет встроенные миграции Postgres по отдельному соединению database/sql
+func Migrations(ctx context.Context, dsn string, migrate MigrateOptions, l *zap.Logger) error {
+	m, err := NewMigrator(dsn, migrate, l)
 	if err != nil {
 		return err
 	}
-	defer func(db *sql.DB) {
-		err := db.Close()
-		if err != nil {
-			panic(err)
+	defer func() {
+		if err := m.Close(); err != nil {
+			l.Error("Ошибка закрытия соединения миграций", zap.Error(err))
 		}
-	}(db)
-
-	if err := goose.SetDialect("postgres"); err != nil {
-		return err
-	}
-
-	return goose.Up(db, "./migration/")
+	}()
+	return autoMigrate(ctx, m)
 }
 
 func (p *Postgre) Ping(ctx context.Context) error {
@@ -73,55 +70,157 @@ func (p *Postgre) AddURL(ctx context.Context, urlData URLData) error {
 	c, cancel := context.WithTimeout(ctx, time.Second*1)
 	defer cancel()
 
-	rows, err := p.db.Query(c, `INSERT INTO url (id, url, is_deleted, user_id) VALUES ($1, $2, $3, $4)`, urlData.ID, urlData.URL, deleted, id)
+	// уведомление отправляется в транзакции вставки: другие экземпляры получают его
+	// только после коммита, и вставка не остаётся без уведомления
+	tx, err := p.db.Begin(c)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
+	defer func() {
+		_ = tx.Rollback(c)
+	}()
+
+	var inserted string
+	err = tx.QueryRow(c, `INSERT INTO url (id, url, is_deleted, user_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, url_hash) WHERE NOT duplicate DO NOTHING RETURNING id`, urlData.ID, urlData.URL, deleted, id).Scan(&inserted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// ON CONFLICT дождался фиксации параллельной вставки, отдельный запрос её уже видит
+		var existID string
+		if err := tx.QueryRow(c, `SELECT id FROM url WHERE user_id = $1 AND NOT duplicate AND `+pgURLMatch("url", "$2::text"), id, urlData.URL).Scan(&existID); err != nil {
+			return err
+		}
+		return &URLExistError{ID: existID}
+	}
+	if err != nil {
+		return uniqueViolation(err)
+	}
+	// новый ID мог быть закеширован как неизвестный
+	if err := p.notify(c, tx, ChangeUpdated, []string{urlData.ID}); err != nil {
+		return err
+	}
+	if err := tx.Commit(c); err != nil {
+		return err
+	}
+	if userID, ok := id.(int); ok {
+		p.replicas.wrote(userID)
+	}
 	return nil
 }
 
+// pgBatchSize сколько URL передаётся одним массивом в проверке существования.
+// Массив — один параметр запроса, поэтому лимит в 65535 параметров не мешает.
+const pgBatchSize = 20000
+
+// WriteBatchURL копирует пачку командой COPY во временную таблицу и переносит
+// в url одним INSERT ... ON CONFLICT. Размер COPY не ограничен: pgx передаёт
+// строки потоком. URL, которые успел сохранить параллельный запрос, получают его ID.
 func (p *Postgre) WriteBatchURL(ctx context.Context, b *ReqBatchURLs) (*ReqBatchURLs, error) {
-	tx, err := p.db.Begin(ctx)
-	if err != nil {
-		return nil, err
-	}
 	id := ctx.Value(UserID)
 	p.Log.Debug("ID из контекста", zap.Any("id", id))
-	deleted := false
 
-	for _, v := range *b {
+	index := make(map[string]int, len(*b))
+	rows := make([][]any, 0, len(*b))
+	for i, v := range *b {
 		// если данные не валидны, пропускаем текущую итерацию
 		if v.Err != nil {
 			continue
 		}
+		index[v.ID] = i
+		rows = append(rows, []any{v.ID, v.URL})
+	}
+	p.Log.Debug("Добавляем пачку URL в БД", zap.Int("count", len(rows)))
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
 
-		p.Log.Debug("Пытаемся добавить URL в БД", zap.String("url", v.URL), zap.String("id", v.ID))
+	if _, err := tx.Exec(ctx, `CREATE TEMP TABLE url_batch (id VARCHAR(8), url TEXT) ON COMMIT DROP`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"url_batch"}, []string{"id", "url"}, pgx.CopyFromRows(rows)); err != nil {
+		return nil, err
+	}
 
-		_, err := tx.Exec(ctx, `INSERT INTO url (id, url, is_deleted, user_id) VALUES ($1, $2, $3, $4)`, v.ID, v.URL, deleted, id)
+	inserted, err := tx.Query(ctx, `INSERT INTO url (id, url, is_deleted, user_id)
+		SELECT id, url, FALSE, $1 FROM url_batch
+		ON CONFLICT (user_id, url_hash) WHERE NOT duplicate DO NOTHING RETURNING id`, id)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(inserted, pgx.RowTo[string])
+	if err != nil {
+		return nil, uniqueViolation(err)
+	}
 
+	if len(ids) < len(rows) {
+		existing, err := tx.Query(ctx, `SELECT b.id, u.id FROM url_batch b
+			JOIN url u ON u.user_id = $1 AND NOT u.duplicate AND `+pgURLMatch("u.url", "b.url")+` AND u.id <> b.id`, id)
 		if err != nil {
-			if err := tx.Rollback(ctx); err != nil {
-				return nil, err
-			}
 			return nil, err
 		}
+		var batchID, existID string
+		_, err = pgx.ForEachRow(existing, []any{&batchID, &existID}, func() error {
+			i := index[batchID]
+			(*b)[i].Err = entity.ErrURLExist
+			(*b)[i].ID = existID
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.notify(ctx, tx, ChangeUpdated, ids); err != nil {
+		return nil, err
 	}
 	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
+	if userID, ok := id.(int); ok {
+		p.replicas.wrote(userID)
+	}
 	return b, nil
 }
 
+// pgUniqueViolation код ошибки Postgres unique_violation
+const pgUniqueViolation = "23505"
+
+// uniqueViolation превращает нарушение уникальности в ошибку сущности:
+// повтор URL пользователя в entity.ErrURLExist, занятый ID в entity.ErrIDExist
+func uniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgUniqueViolation {
+		return err
+	}
+	switch pgErr.ConstraintName {
+	case "url_user_id_url_hash_key":
+		return fmt.Errorf("%w: %s", entity.ErrURLExist, pgErr.ConstraintName)
+	case "url_pkey":
+		return fmt.Errorf("%w: %s", entity.ErrIDExist, pgErr.ConstraintName)
+	default:
+		return err
+	}
+}
+
+// pgURLMatch условие поиска URL: по индексу хеша, затем сравнение самих строк
+func pgURLMatch(column, value string) string {
+	return fmt.Sprintf("%[1]s_hash = sha256(convert_to(%[2]s, 'UTF8')) AND %[1]s = %[2]s", column, value)
+}
+
 func (p *Postgre) CheckID(ctx context.Context, id string) (URLData, bool, error) {
-	return p.check(ctx, "id", id)
+	return p.check(ctx, "id = $1", id, true)
 }
 
 func (p *Postgre) CheckURL(ctx context.Context, url string) (URLData, bool, error) {
-	return p.check(ctx, "url", url)
+	return p.check(ctx, "NOT duplicate AND "+pgURLMatch("url", "$1::text"), url, false)
 }
 
-func (p *Postgre) check(ctx context.Context, t string, v string) (URLData, bool, error) {
+// check ищет ссылку по условию cond с параметром v. byID — v это ID ссылки.
+func (p *Postgre) check(ctx context.Context, cond string, v string, byID bool) (URLData, bool, error) {
 	var returnID string
 	var returnURL string
 	var deleted bool
@@ -130,14 +229,20 @@ func (p *Postgre) check(ctx context.Context, t string, v string) (URLData, bool,
 
 	c := context.WithoutCancel(ctx)
 
-	var err error
-	if userID == 0 {
-		insertType := fmt.Sprintf("SELECT id, url, is_deleted FROM url WHERE %v = $1", t)
-		err = p.db.QueryRow(c, insertType, v).Scan(&returnID, &returnURL, &deleted)
-	} else {
-		insertType := fmt.Sprintf("SELECT id, url, is_deleted FROM url WHERE %v = $1 AND user_id = $2", t)
-		err = p.db.QueryRow(c, insertType, v, userID).Scan(&returnID, &returnURL, &deleted)
+	uid, _ := userID.(int)
+	id := ""
+	if byID {
+		id = v
 	}
+	err := p.read(c, uid, id, func(db *pgxpool.Pool) error {
+		// ID уникален во всём хранилище, по нему ищем без пользователя
+		if byID || userID == 0 {
+			insertType := "SELECT id, url, is_deleted FROM url WHERE " + cond
+			return db.QueryRow(c, insertType, v).Scan(&returnID, &returnURL, &deleted)
+		}
+		insertType := "SELECT id, url, is_deleted FROM url WHERE " + cond + " AND user_id = $2"
+		return db.QueryRow(c, insertType, v, userID).Scan(&returnID, &returnURL, &deleted)
+	})
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -153,89 +258,111 @@ func (p *Postgre) check(ctx context.Context, t string, v string) (URLData, bool,
 	return URLData{URL: returnURL, ID: returnID, Deleted: deleted}, true, nil
 }
 
-func (p *Postgre) CheckBatchURL(ctx context.Context, urls *ReqBatchURLs) (*ReqBatchURLs, error) { //nolint: funlen
-	c, cancel := context.WithTimeout(ctx, time.Second*1)
-	defer cancel()
-
-	// получаем данные для составления запроса
-	val, queryInsert := p.getQueryInsert(ctx, urls)
+// CheckBatchURL ищет уже сокращённые URL пачки. URL передаются массивом
+// через unnest, по pgBatchSize за запрос. Как и CheckURL, при известном
+// пользователе ищет только среди его ссылок.
+func (p *Postgre) CheckBatchURL(ctx context.Context, urls *ReqBatchURLs) (*ReqBatchURLs, error) {
+	query := `SELECT u.url, u.id, COALESCE(u.is_deleted, FALSE)
+			FROM url u JOIN unnest($1::text[]) AS t(url) ON NOT u.duplicate AND ` + pgURLMatch("u.url", "t.url")
+	userID, _ := ctx.Value(UserID).(int)
+	if userID != 0 {
+		query += " WHERE u.user_id = $2"
+	}
 
-	// Проверка существования урлов в базе данных
-	query := "SELECT url, id, is_deleted FROM url WHERE url IN (" + queryInsert + ")"
-	rows, err := p.db.Query(c, query, val...)
-	if err != nil {
-		p.Log.Error("Error querying database:", zap.Error(err))
-		return nil, err
+	index := make(map[string][]int, len(*urls))
+	values := make([]string, 0, len(*urls))
+	for i, v := range *urls {
+		if v.Err != nil {
+			continue
+		}
+		if _, ok := index[v.URL]; !ok {
+			values = append(values, v.URL)
+		}
+		index[v.URL] = append(index[v.URL], i)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var url string
-		var id string
-		var deleted bool
-		err := rows.Scan(&url, &id, &deleted)
-		if err != nil {
-			p.Log.Error("Error scanning row:", zap.Error(err))
-			return nil, err
+	for len(values) > 0 {
+		chunk := values[:min(len(values), pgBatchSize)]
+		values = values[len(chunk):]
+
+		args := []any{chunk}
+		if userID != 0 {
+			args = append(args, userID)
 		}
-		for i, v := range *urls {
-			if v.URL == url {
-				(*urls)[i].Err = entity.ErrURLExist
-				(*urls)[i].ID = id
-				(*urls)[i].Deleted = deleted
+		// как и CheckURL, читаем с реплики: пропущенный ею URL найдёт вставка ON CONFLICT
+		err := p.read(ctx, userID, "", func(db *pgxpool.Pool) error {
+			rows, err := db.Query(ctx, query, args...)
+			if err != nil {
+				p.Log.Error("Error querying database:", zap.Error(err))
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var url string
+				var id string
+				var deleted bool
+				if err := rows.Scan(&url, &id, &deleted); err != nil {
+					p.Log.Error("Error scanning row:", zap.Error(err))
+					return err
+				}
+				for _, i := range index[url] {
+					(*urls)[i].Err = entity.ErrURLExist
+					(*urls)[i].ID = id
+					(*urls)[i].Deleted = deleted
+				}
 			}
+			return rows.Err()
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 	return urls, nil
 }
 
-func (p *Postgre) getQueryInsert(_ context.Context, urls *ReqBatchURLs) ([]interface{}, string) {
-	val := make([]interface{}, 0, len(*urls))
-	var queryInsert string
-	i := 0
-	for _, v := range *urls {
-		if v.Err != nil {
-			continue
-		}
-		val = append(val, v.URL)
-		queryInsert += fmt.Sprintf("$%v", i+1)
-		queryInsert += ","
-		i++
+func (p *Postgre) RemoveURL(ctx context.Context, data []URLData) error {
+	userID, ok := ctx.Value(UserID).(int)
+	if !ok || userID == 0 {
+		return entity.ErrUnknownUser
 	}
 
-	queryInsert = strings.TrimSuffix(queryInsert, ",")
-	return val, queryInsert
-}
+	ids := make([]string, 0, len(data))
+	for _, url := range data {
+		ids = append(ids, url.ID)
+	}
 
-func (p *Postgre) RemoveURL(ctx context.Context, data []URLData) error {
-	remove := true
-	c := context.WithoutCancel(ctx)
-	tx, err := p.db.Begin(context.Background())
+	tx, err := p.db.Begin(ctx)
 	if err != nil {
-		log.Fatalf("Unable to begin transaction: %v", err)
+		return err
 	}
-
 	defer func() {
-		if err != nil {
-			err := tx.Rollback(context.Background())
-			if err != nil {
-				p.Log.Error("Rollback transaction failed", zap.Error(err))
-			}
-			p.Log.Error("Transaction failed", zap.Error(err))
-		} else {
-			err := tx.Commit(context.Background())
-			if err != nil {
-				p.Log.Error("Commit transaction failed", zap.Error(err))
-			}
-		}
+		_ = tx.Rollback(ctx)
 	}()
 
-	for _, url := range data {
-		_, err := tx.Exec(c, "UPDATE url SET is_deleted = $1 WHERE id = $2", remove, url.ID)
-		if err != nil {
-			return err
-		}
+	// удаляем только ссылки, принадлежащие пользователю из контекста
+	rows, err := tx.Query(ctx, "UPDATE url SET is_deleted = true WHERE user_id = $1 AND id = ANY($2) RETURNING id", userID, ids)
+	if err != nil {
+		p.Log.Error("Ошибка удаления URL", zap.Error(err))
+		return err
+	}
+	removed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		p.Log.Error("Ошибка удаления URL", zap.Error(err))
+		return err
+	}
+	if len(removed) != len(ids) {
+		p.Log.Info("Часть URL не принадлежит пользователю и не удалена",
+			zap.Int("user", userID), zap.Int("requested", len(ids)), zap.Int("removed", len(removed)))
+	}
+
+	// уведомление уйдёт вместе с коммитом, и другие экземпляры сбросят ссылки из кешей
+	if err := p.notify(ctx, tx, ChangeDeleted, removed); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
 	}
+	p.replicas.wrote(userID)
 	return nil
 }
 
@@ -252,75 +379,221 @@ func (p *Postgre) GetNewUser(ctx context.Context) (int, error) {
 	return id, nil
 }
 
+// OwnedIDs читает с primary: реплика могла ещё не получить только что созданные ссылки
+func (p *Postgre) OwnedIDs(ctx context.Context, userID int, ids []string) ([]string, error) {
+	rows, err := p.db.Query(ctx, "SELECT id FROM url WHERE user_id = $1 AND id = ANY($2::varchar[])", userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
 func (p *Postgre) GetURLsByUser(ctx context.Context, id int) (UserURLs, error) {
 	c, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	p.Log.Debug("Получаем все URL пользователя", zap.Int("id", id))
 
-	urls := UserURLs{}
-	rows, err := p.db.Query(c, "SELECT url, id, is_deleted FROM url WHERE user_id = $1", id)
+	var urls UserURLs
+	err := p.read(c, id, "", func(db *pgxpool.Pool) error {
+		rows, err := db.Query(c, "SELECT url, id, is_deleted FROM url WHERE user_id = $1", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		urls = UserURLs{}
+		for rows.Next() {
+			var url string
+			var shortID string
+			var deleted bool
+			err := rows.Scan(&url, &shortID, &deleted)
+			if err != nil {
+				p.Log.Error("Error scanning row:", zap.Error(err))
+				return err
+			}
+			urls = append(urls, URLData{
+				URL:     url,
+				ID:      shortID,
+				Deleted: deleted,
+			})
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (p *Postgre) AppendDeletes(ctx context.Context, tasks []DeleteTask) error {
+	ids, users := splitDeleteTasks(tasks)
+	_, err := p.db.Exec(ctx, `INSERT INTO delete_queue (id, user_id)
+		SELECT * FROM unnest($1::varchar[], $2::int[]) ON CONFLICT DO NOTHING`, ids, users)
+	return err
+}
+
+func (p *Postgre) AckDeletes(ctx context.Context, tasks []DeleteTask) error {
+	ids, users := splitDeleteTasks(tasks)
+	_, err := p.db.Exec(ctx, `DELETE FROM delete_queue q
+		USING unnest($1::varchar[], $2::int[]) AS t(id, user_id)
+		WHERE q.id = t.id AND q.user_id = t.user_id`, ids, users)
+	return err
+}
+
+func (p *Postgre) PendingDeletes(ctx context.Context) ([]DeleteTask, error) {
+	rows, err := p.db.Query(ctx, "SELECT id, user_id FROM delete_queue")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+
+	var tasks []DeleteTask
 	for rows.Next() {
-		var url string
-		var shortID string
-		var deleted bool
-		err := rows.Scan(&url, &shortID, &deleted)
-		if err != nil {
-			p.Log.Error("Error scanning row:", zap.Error(err))
+		var t DeleteTask
+		if err := rows.Scan(&t.ID, &t.UserID); err != nil {
 			return nil, err
 		}
-		urls = append(urls, URLData{
-			URL:     url,
-			ID:      shortID,
-			Deleted: deleted,
-		})
+		tasks = append(tasks, t)
 	}
-	return urls, nil
+	return tasks, rows.Err()
+}
+
+func splitDeleteTasks(tasks []DeleteTask) ([]string, []int) {
+	ids := make([]string, 0, len(tasks))
+	users := make([]int, 0, len(tasks))
+	for _, t := range tasks {
+		ids = append(ids, t.ID)
+		users = append(users, t.UserID)
+	}
+	return ids, users
+}
+
+func init() {
+	open := func(ctx context.Context, dsn string, opts Options, l *zap.Logger) (Store, error) {
+		return OpenPostgres(ctx, dsn, opts.Migrate, l)
+	}
+	Register("postgres", open)
+	Register("postgresql", open)
 }
 
-func SetPostgres(ctx context.Context, conf *config.Config, l *zap.Logger) (*pgxpool.Pool, Repository) {
-	db, err := configurePool(conf)
+// OpenPostgres подключается к Postgres и применяет миграции. Настройки пула,
+// например pool_max_conns и statement_timeout, задаются параметрами DSN,
+// реплики для чтения — параметрами replica, см. pgOptions.
+func OpenPostgres(ctx context.Context, dsn string, migrate MigrateOptions, l *zap.Logger) (*Postgre, error) {
+	dsn, opts, err := parsePgOptions(dsn)
+	if err != nil {
+		return nil, err
+	}
+	configPool, err := pgPoolConfig(dsn, pgDefaultMaxConns)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	stor := NewPostgreBase(db, l)
-	err = stor.Ping(ctx)
+	db, err := pgxpool.NewWithConfig(ctx, configPool)
 	if err != nil {
-		fprintf, err := fmt.Fprintf(os.Stderr, "Can't connect to database: %v\n", err)
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+
+	stor := NewPostgreBase(db, l)
+	if err := stor.Ping(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't connect to database: %w", err)
+	}
+
+	if err := Migrations(ctx, dsn, migrate, l); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't created table: %w", err)
+	}
+
+	if len(opts.Replicas) > 0 {
+		stor.replicas, err = openPgReplicas(ctx, configPool, opts, l)
 		if err != nil {
-			return nil, nil
+			db.Close()
+			return nil, err
 		}
-		panic(fprintf)
 	}
+	return stor, nil
+}
+
+func (p *Postgre) Close() error {
+	p.stopListen()
+	p.replicas.Close()
+	p.db.Close()
+	return nil
+}
 
-	err = Migrations(conf.DataBase)
+func (p *Postgre) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := p.db.QueryRow(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE is_deleted),
+		(SELECT COALESCE(MAX(id), 0) FROM users) FROM url`).Scan(&stats.URLs, &stats.Deleted, &stats.LastUserID)
+	return stats, err
+}
+
+func (p *Postgre) ExportURLs(ctx context.Context, after string, limit int) ([]Record, error) {
+	rows, err := p.db.Query(ctx, `SELECT id, url, COALESCE(user_id, 0), COALESCE(is_deleted, FALSE), duplicate
+		FROM url WHERE id > $1 ORDER BY id LIMIT $2`, after, limit)
 	if err != nil {
-		fprintf, err := fmt.Fprintf(os.Stderr, "Can't created table: %v\n", err)
-		if err != nil {
-			return nil, nil
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.URL, &r.UserID, &r.Deleted, &r.Duplicate); err != nil {
+			return nil, err
 		}
-		panic(fprintf)
+		records = append(records, r)
 	}
+	return records, rows.Err()
+}
 
-	return db, stor
+func (p *Postgre) ImportUsers(ctx context.Context, lastUserID int) error {
+	if lastUserID <= 0 {
+		return nil
+	}
+	_, err := p.db.Exec(ctx, `INSERT INTO users (id) SELECT generate_series(1, $1) ON CONFLICT DO NOTHING`, lastUserID)
+	if err != nil {
+		return err
+	}
+	// после явной вставки ID сдвигаем последовательность, чтобы новые пользователи не столкнулись с перенесёнными
+	_, err = p.db.Exec(ctx, `SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT MAX(id) FROM users))`)
+	return err
 }
 
-func configurePool(conf *config.Config) (*pgxpool.Pool, error) {
-	configPool, err := pgxpool.ParseConfig(conf.DataBase)
+func (p *Postgre) ImportURLs(ctx context.Context, records []Record) error {
+	ids := make([]string, 0, len(records))
+	urls := make([]string, 0, len(records))
+	deleted := make([]bool, 0, len(records))
+	users := make([]int, 0, len(records))
+	duplicates := make([]bool, 0, len(records))
+	for _, r := range records {
+		ids = append(ids, r.ID)
+		urls = append(urls, r.URL)
+		deleted = append(deleted, r.Deleted)
+		users = append(users, r.UserID)
+		duplicates = append(duplicates, r.Duplicate)
+	}
+
+	tx, err := p.db.Begin(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	configPool.MaxConns = 10
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
 
-	db, err := pgxpool.NewWithConfig(context.Background(), configPool)
+	// дубли переносятся с признаком duplicate, иначе второй из них нарушил бы уникальный индекс
+	_, err = tx.Exec(ctx, `INSERT INTO url (id, url, is_deleted, user_id, duplicate)
+		SELECT id, url, is_deleted, NULLIF(user_id, 0), duplicate
+		FROM unnest($1::varchar[], $2::text[], $3::bool[], $4::int[], $5::bool[]) AS t(id, url, is_deleted, user_id, duplicate)
+		ON CONFLICT (id) DO UPDATE SET is_deleted = EXCLUDED.is_deleted`, ids, urls, deleted, users, duplicates)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	if err := p.notify(ctx, tx, ChangeUpdated, ids); err != nil {
+		return err
 	}
-	return db, err
+	return tx.Commit(ctx)
 }
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrMigrationLock блокировку миграций не удалось получить за MigrateOptions.LockTimeout
+var ErrMigrationLock = errors.New("migration lock timeout")
+
+// DefaultMigrationLockTimeout ожидание блокировки миграций, если MigrateOptions.LockTimeout не задан
+const DefaultMigrationLockTimeout = 5 * time.Minute
+
+// pgMigrationLockID ключ advisory lock миграций, ASCII "urlshort"
+const pgMigrationLockID int64 = 0x75726c73686f7274
+
+// pgMigrationLockRetry период повторных попыток взять занятую блокировку
+const pgMigrationLockRetry = 500 * time.Millisecond
+
+// pgMigrationLock сериализует миграции между экземплярами сервиса сессионным advisory lock.
+// Пока один экземпляр мигрирует, остальные ждут блокировку и затем видят актуальную схему.
+type pgMigrationLock struct {
+	timeout time.Duration
+	log     *zap.Logger
+}
+
+func (l *pgMigrationLock) SessionLock(ctx context.Context, conn *sql.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	start := time.Now()
+	expired := func() error {
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ctx.Err()
+		}
+		l.log.Error("Не дождались блокировки миграций", zap.Duration("timeout", l.timeout))
+		return fmt.Errorf("%w after %s", ErrMigrationLock, l.timeout)
+	}
+	for waiting := false; ; waiting = true {
+		var ok bool
+		err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, pgMigrationLockID).Scan(&ok)
+		if err != nil {
+			if ctx.Err() != nil {
+				return expired()
+			}
+			return err
+		}
+		if ok {
+			if waiting {
+				l.log.Info("Получили блокировку миграций", zap.Duration("waited", time.Since(start)))
+			}
+			return nil
+		}
+		if !waiting {
+			l.log.Info("Миграции выполняет другой экземпляр, ждём блокировку", zap.Duration("timeout", l.timeout))
+		}
+
+		select {
+		case <-ctx.Done():
+			return expired()
+		case <-time.After(pgMigrationLockRetry):
+		}
+	}
+}
+
+func (l *pgMigrationLock) SessionUnlock(ctx context.Context, conn *sql.Conn) error {
+	var ok bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_advisory_unlock($1)`, pgMigrationLockID).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("migration lock is not held")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+)
+
+// changesChannel канал NOTIFY, в который экземпляры сервиса сообщают об изменении ссылок
+const changesChannel = "url_changes"
+
+// maxNotifyIDs ограничивает количество ID в одном уведомлении: payload NOTIFY меньше 8000 байт
+const maxNotifyIDs = 500
+
+const (
+	// ChangeDeleted ссылки помечены удалёнными
+	ChangeDeleted = "deleted"
+	// ChangeUpdated ссылки добавлены или изменены
+	ChangeUpdated = "updated"
+	// ChangePurge уведомления могли потеряться, локальные кеши нужно сбросить целиком
+	ChangePurge = "purge"
+)
+
+// ChangeEvent изменение ссылок, сделанное этим или другим экземпляром сервиса
+type ChangeEvent struct {
+	Op  string   `json:"op"`
+	IDs []string `json:"ids,omitempty"`
+}
+
+// ChangeListener хранилище, которое сообщает об изменениях ссылок от всех экземпляров сервиса
+type ChangeListener interface {
+	// Listen вызывает fn для каждого изменения, пока не отменён ctx или не закрыто хранилище
+	Listen(ctx context.Context, fn func(ChangeEvent))
+}
+
+var _ ChangeListener = (*Postgre)(nil)
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// notify публикует изменение. Внутри транзакции уведомление уходит только после коммита.
+// Все части уведомления отправляются одним запросом.
+func (p *Postgre) notify(ctx context.Context, db execer, op string, ids []string) error {
+	// свои изменения отмечаем сразу, не дожидаясь уведомления
+	p.replicas.change(ChangeEvent{Op: op, IDs: ids})
+	payloads := changePayloads(op, ids)
+	if len(payloads) == 0 {
+		return nil
+	}
+	_, err := db.Exec(ctx, "SELECT pg_notify($1, payload) FROM unnest($2::text[]) AS payload", changesChannel, payloads)
+	return err
+}
+
+// changePayloads делит ID на уведомления допустимого размера
+func changePayloads(op string, ids []string) []string {
+	payloads := make([]string, 0, len(ids)/maxNotifyIDs+1)
+	for len(ids) > 0 {
+		chunk := ids[:min(len(ids), maxNotifyIDs)]
+		ids = ids[len(chunk):]
+
+		b, _ := json.Marshal(ChangeEvent{Op: op, IDs: chunk})
+		payloads = append(payloads, string(b))
+	}
+	return payloads
+}
+
+// Listen слушает канал изменений на отдельном соединении и переподключается при обрыве.
+// После каждого LISTEN, и первого тоже, отправляет ChangePurge: пока соединения не было,
+// уведомления терялись. По нему подписчики заполняют состояние, не пропуская изменений.
+func (p *Postgre) Listen(ctx context.Context, fn func(ChangeEvent)) {
+	ctx, cancel := context.WithCancel(ctx)
+	p.listenCancel = cancel
+	p.listenDone = make(chan struct{})
+
+	go func() {
+		defer close(p.listenDone)
+
+		const maxBackoff = 30 * time.Second
+		backoff := time.Second
+		for {
+			established, err := p.listen(ctx, fn)
+			if ctx.Err() != nil {
+				return
+			}
+			if established {
+				backoff = time.Second
+			}
+			p.Log.Error("Потеряно соединение LISTEN, переподключаемся", zap.Error(err), zap.Duration("after", backoff))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}()
+}
+
+// listen возвращается при ошибке соединения. established сообщает, что LISTEN успел выполниться.
+func (p *Postgre) listen(ctx context.Context, fn func(ChangeEvent)) (bool, error) {
+	conn, err := p.db.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// соединение с LISTEN не возвращаем в пул, закрываем сами
+	pc := conn.Hijack()
+	defer func() {
+		_ = pc.Close(context.Background())
+	}()
+
+	if _, err := pc.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return false, err
+	}
+	p.Log.Info("Слушаем изменения ссылок", zap.String("channel", changesChannel))
+	p.replicas.change(ChangeEvent{Op: ChangePurge})
+	fn(ChangeEvent{Op: ChangePurge})
+
+	for {
+		n, err := pc.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		var ev ChangeEvent
+		if err := json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+			p.Log.Error("Не разобрали уведомление", zap.String("payload", n.Payload), zap.Error(err))
+			continue
+		}
+		// отмечаем до fn: сброшенную из кеша ссылку следующее чтение возьмёт с primary
+		p.replicas.change(ev)
+		fn(ev)
+	}
+}
+
+// stopListen останавливает прослушивание и ждёт освобождения соединения
+func (p *Postgre) stopListen() {
+	if p.listenCancel == nil {
+		return
+	}
+	p.listenCancel()
+	<-p.listenDone
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangePayloads(t *testing.T) {
+	assert.Empty(t, changePayloads(ChangeUpdated, nil))
+
+	ids := make([]string, maxNotifyIDs*2+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%08d", i)
+	}
+
+	payloads := changePayloads(ChangeDeleted, ids)
+	require.Len(t, payloads, 3)
+
+	var got []string
+	for _, p := range payloads {
+		// payload NOTIFY по умолчанию ограничен 8000 байт
+		assert.Less(t, len(p), 8000)
+
+		var ev ChangeEvent
+		require.NoError(t, json.Unmarshal([]byte(p), &ev))
+		assert.Equal(t, ChangeDeleted, ev.Op)
+		got = append(got, ev.IDs...)
+	}
+	assert.Equal(t, ids, got)
+}
@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// pgDefaultMaxConns размер пула, если в DSN нет pool_max_conns
+const pgDefaultMaxConns = 10
+
+// pgOptions параметры DSN Postgres, которые обрабатывает хранилище, а не pgx:
+//
+//	replica            DSN реплики для чтения, можно указать несколько раз
+//	replica_max_conns  размер пула каждой реплики, по умолчанию как у primary
+//	read_your_writes   сколько после записи читать данные пользователя с primary (0 - выкл)
+//	health_interval    период проверки реплик
+//	health_timeout     таймаут проверки реплики
+//	replica_max_lag    реплика с большим отставанием не используется (0 - не проверять)
+//
+// statement_timeout и pool_max_conns разбирает сам pgx, statement_timeout primary
+// наследуют реплики, в DSN которых он не задан.
+type pgOptions struct {
+	Replicas        []string
+	ReplicaMaxConns int32
+	ReadYourWrites  time.Duration
+	HealthInterval  time.Duration
+	HealthTimeout   time.Duration
+	MaxLag          time.Duration
+}
+
+// parsePgOptions отделяет параметры хранилища от DSN. DSN в формате key=value
+// передаётся pgx без изменений.
+func parsePgOptions(dsn string) (string, pgOptions, error) {
+	opts := pgOptions{
+		ReadYourWrites: 5 * time.Second,
+		HealthInterval: 5 * time.Second,
+		HealthTimeout:  time.Second,
+		MaxLag:         5 * time.Second,
+	}
+	if !strings.Contains(dsn, "://") {
+		return dsn, opts, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", opts, err
+	}
+	q := u.Query()
+
+	opts.Replicas = q["replica"]
+	if v := q.Get("replica_max_conns"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || n < 1 {
+			return "", opts, fmt.Errorf("invalid replica_max_conns %q", v)
+		}
+		opts.ReplicaMaxConns = int32(n)
+	}
+	durations := map[string]*time.Duration{
+		"read_your_writes": &opts.ReadYourWrites,
+		"health_interval":  &opts.HealthInterval,
+		"health_timeout":   &opts.HealthTimeout,
+		"replica_max_lag":  &opts.MaxLag,
+	}
+	for name, d := range durations {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		if *d, err = time.ParseDuration(v); err != nil {
+			return "", opts, fmt.Errorf("invalid %s %q: %w", name, v, err)
+		}
+	}
+	if opts.HealthInterval <= 0 || opts.HealthTimeout <= 0 {
+		return "", opts, errors.New("health_interval and health_timeout must be positive")
+	}
+
+	q.Del("replica")
+	q.Del("replica_max_conns")
+	for name := range durations {
+		q.Del(name)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), opts, nil
+}
+
+// pgPoolConfig настройки пула из DSN. Без pool_max_conns пул ограничен maxConns соединениями.
+func pgPoolConfig(dsn string, maxConns int32) (*pgxpool.Config, error) {
+	conf, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(dsn, "pool_max_conns") {
+		conf.MaxConns = maxConns
+	}
+	return conf, nil
+}
+
+type pgReplica struct {
+	host    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// staleFor сколько после изменения ссылки читать её с primary: за это время
+// реплика с допустимым отставанием успевает его получить
+func (o pgOptions) staleFor() time.Duration {
+	return max(o.ReadYourWrites, o.MaxLag+o.HealthInterval)
+}
+
+// pgReplicas реплики для чтения. Запросы распределяются по кругу между здоровыми
+// репликами, пользователь после записи читает с primary в течение read_your_writes.
+// Изменённые ссылки читаются с primary, пока реплики их не получат: иначе кеш
+// запомнил бы с реплики удалённую ссылку как живую.
+type pgReplicas struct {
+	list []*pgReplica
+	opts pgOptions
+	log  *zap.Logger
+	next atomic.Uint64
+
+	mu      sync.Mutex
+	writes  map[int]time.Time
+	changed map[string]time.Time
+	// purged до этого времени все ссылки читаются с primary: уведомления об изменениях терялись
+	purged time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// openPgReplicas создаёт пулы реплик. Недоступная при старте реплика не мешает
+// открыть хранилище: чтение идёт с primary, пока проверка не найдёт её здоровой.
+func openPgReplicas(ctx context.Context, primary *pgxpool.Config, opts pgOptions, l *zap.Logger) (*pgReplicas, error) {
+	maxConns := opts.ReplicaMaxConns
+	if maxConns == 0 {
+		maxConns = primary.MaxConns
+	}
+
+	r := &pgReplicas{
+		opts:    opts,
+		log:     l,
+		writes:  make(map[int]time.Time),
+		changed: make(map[string]time.Time),
+	}
+	for _, dsn := range opts.Replicas {
+		conf, err := pgPoolConfig(dsn, maxConns)
+		if err != nil {
+			r.closePools()
+			return nil, fmt.Errorf("replica dsn: %w", err)
+		}
+		if timeout, ok := primary.ConnConfig.RuntimeParams["statement_timeout"]; ok {
+			if _, set := conf.ConnConfig.RuntimeParams["statement_timeout"]; !set {
+				conf.ConnConfig.RuntimeParams["statement_timeout"] = timeout
+			}
+		}
+		pool, err := pgxpool.NewWithConfig(ctx, conf)
+		if err != nil {
+			r.closePools()
+			return nil, fmt.Errorf("unable to connect to replica: %w", err)
+		}
+		r.list = append(r.list, &pgReplica{host: conf.ConnConfig.Host, pool: pool})
+	}
+
+	r.checkAll(ctx)
+	for _, rep := range r.list {
+		if !rep.healthy.Load() {
+			r.log.Warn("Реплика недоступна при старте, читаем с primary", zap.String("host", rep.host))
+		}
+	}
+	hctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.run(hctx)
+	return r, nil
+}
+
+// pick здоровая реплика для чтения данных пользователя или ссылки id, nil — читать с primary
+func (r *pgReplicas) pick(userID int, id string) *pgReplica {
+	if r == nil || r.recentWrite(userID) || r.recentChange(id) {
+		return nil
+	}
+	n := uint64(len(r.list))
+	start := r.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if rep := r.list[(start+i)%n]; rep.healthy.Load() {
+			return rep
+		}
+	}
+	return nil
+}
+
+// wrote отмечает запись пользователя для read-your-writes
+func (r *pgReplicas) wrote(userID int) {
+	if r == nil || userID == 0 || r.opts.ReadYourWrites <= 0 {
+		return
+	}
+	r.mu.Lock()
+	r.writes[userID] = time.Now().Add(r.opts.ReadYourWrites)
+	r.mu.Unlock()
+}
+
+// change отмечает изменение ссылок этим или другим экземпляром сервиса
+func (r *pgReplicas) change(ev ChangeEvent) {
+	if r == nil {
+		return
+	}
+	until := time.Now().Add(r.opts.staleFor())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ev.Op == ChangePurge {
+		r.purged = until
+		return
+	}
+	for _, id := range ev.IDs {
+		r.changed[id] = until
+	}
+}
+
+func (r *pgReplicas) recentChange(id string) bool {
+	if id == "" {
+		return false
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Before(r.purged) {
+		return true
+	}
+	until, ok := r.changed[id]
+	return ok && now.Before(until)
+}
+
+func (r *pgReplicas) recentWrite(userID int) bool {
+	if userID == 0 || r.opts.ReadYourWrites <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.writes[userID]
+	return ok && time.Now().Before(until)
+}
+
+// markDown выводит реплику из чтения до следующей успешной проверки
+func (r *pgReplicas) markDown(rep *pgReplica, err error) {
+	if rep.healthy.Swap(false) {
+		r.log.Warn("Реплика недоступна, читаем с primary", zap.String("host", rep.host), zap.Error(err))
+	}
+}
+
+func (r *pgReplicas) run(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.checkAll(ctx)
+			r.pruneWrites()
+		}
+	}
+}
+
+func (r *pgReplicas) checkAll(ctx context.Context) {
+	for _, rep := range r.list {
+		err := r.check(ctx, rep)
+		if err != nil {
+			r.markDown(rep, err)
+			continue
+		}
+		if !rep.healthy.Swap(true) {
+			r.log.Info("Реплика доступна для чтения", zap.String("host", rep.host))
+		}
+	}
+}
+
+// check проверяет соединение и отставание реплики. Реплика, применившая весь
+// полученный WAL, не отстаёт, даже если primary давно не писал.
+func (r *pgReplicas) check(ctx context.Context, rep *pgReplica) error {
+	c, cancel := context.WithTimeout(ctx, r.opts.HealthTimeout)
+	defer cancel()
+
+	var lag float64
+	err := rep.pool.QueryRow(c, `SELECT COALESCE(CASE
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END, 0)::float8`).Scan(&lag)
+	if err != nil {
+		return err
+	}
+	if r.opts.MaxLag > 0 {
+		if d := time.Duration(lag * float64(time.Second)); d > r.opts.MaxLag {
+			return fmt.Errorf("replication lag %s exceeds %s", d.Round(time.Millisecond), r.opts.MaxLag)
+		}
+	}
+	return nil
+}
+
+func (r *pgReplicas) pruneWrites() {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, until := range r.writes {
+		if now.After(until) {
+			delete(r.writes, id)
+		}
+	}
+	for id, until := range r.changed {
+		if now.After(until) {
+			delete(r.changed, id)
+		}
+	}
+}
+
+func (r *pgReplicas) closePools() {
+	for _, rep := range r.list {
+		rep.pool.Close()
+	}
+}
+
+// Close останавливает проверки и закрывает пулы реплик
+func (r *pgReplicas) Close() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+	r.closePools()
+}
+
+// read выполняет чтение на реплике, а при её ошибке повторяет запрос на primary.
+// id — ссылка, которую ищут по ID: если реплика её ещё не получила, ищем на primary,
+// чтобы не ответить «не найдено» на только что созданную ссылку.
+func (p *Postgre) read(ctx context.Context, userID int, id string, fn func(db *pgxpool.Pool) error) error {
+	rep := p.replicas.pick(userID, id)
+	if rep == nil {
+		return fn(p.db)
+	}
+	err := fn(rep.pool)
+	if errors.Is(err, pgx.ErrNoRows) && id != "" && ctx.Err() == nil {
+		return fn(p.db)
+	}
+	if err == nil || errors.Is(err, pgx.ErrNoRows) || ctx.Err() != nil {
+		return err
+	}
+	p.replicas.markDown(rep, err)
+	return fn(p.db)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParsePgOptions(t *testing.T) {
+	dsn, opts, err := parsePgOptions("postgres://u:p@primary:5432/db?sslmode=disable&statement_timeout=2s" +
+		"&replica=postgres%3A%2F%2Fu%3Ap%40r1%2Fdb&replica=postgres%3A%2F%2Fu%3Ap%40r2%2Fdb" +
+		"&replica_max_conns=4&read_your_writes=1s&health_interval=2s&replica_max_lag=10s")
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://u:p@primary:5432/db?sslmode=disable&statement_timeout=2s", dsn)
+	assert.Equal(t, pgOptions{
+		Replicas:        []string{"postgres://u:p@r1/db", "postgres://u:p@r2/db"},
+		ReplicaMaxConns: 4,
+		ReadYourWrites:  time.Second,
+		HealthInterval:  2 * time.Second,
+		HealthTimeout:   time.Second,
+		MaxLag:          10 * time.Second,
+	}, opts)
+	assert.Equal(t, 12*time.Second, opts.staleFor())
+
+	// key=value передаётся pgx как есть
+	dsn, opts, err = parsePgOptions("host=localhost dbname=db")
+	require.NoError(t, err)
+	assert.Equal(t, "host=localhost dbname=db", dsn)
+	assert.Empty(t, opts.Replicas)
+	assert.Equal(t, 5*time.Second, opts.MaxLag, "отставание реплик проверяется по умолчанию")
+
+	for _, bad := range []string{
+		"postgres://h/db?replica_max_conns=0",
+		"postgres://h/db?read_your_writes=soon",
+		"postgres://h/db?health_interval=0s",
+	} {
+		_, _, err := parsePgOptions(bad)
+		assert.Error(t, err, bad)
+	}
+
+	conf, err := pgPoolConfig(dsn, pgDefaultMaxConns)
+	require.NoError(t, err)
+	assert.Equal(t, int32(pgDefaultMaxConns), conf.MaxConns)
+	conf, err = pgPoolConfig("postgres://h/db?pool_max_conns=3", pgDefaultMaxConns)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), conf.MaxConns)
+}
+
+func TestPgReplicasPick(t *testing.T) {
+	var none *pgReplicas
+	assert.Nil(t, none.pick(1, ""))
+	none.wrote(1)
+
+	r := &pgReplicas{
+		list:    []*pgReplica{{host: "r1"}, {host: "r2"}},
+		opts:    pgOptions{ReadYourWrites: time.Minute},
+		log:     zap.NewNop(),
+		writes:  make(map[int]time.Time),
+		changed: make(map[string]time.Time),
+	}
+	assert.Nil(t, r.pick(1, ""), "нет здоровых реплик — читаем с primary")
+
+	r.list[0].healthy.Store(true)
+	r.list[1].healthy.Store(true)
+	seen := map[string]int{}
+	for i := 0; i < 10; i++ {
+		seen[r.pick(1, "").host]++
+	}
+	assert.Equal(t, map[string]int{"r1": 5, "r2": 5}, seen)
+
+	// автор только что записанных ссылок читает с primary, остальные — с реплик
+	r.wrote(1)
+	assert.Nil(t, r.pick(1, ""))
+	assert.NotNil(t, r.pick(2, ""))
+	r.writes[1] = time.Now().Add(-time.Second)
+	assert.NotNil(t, r.pick(1, ""))
+	r.pruneWrites()
+	assert.Empty(t, r.writes)
+
+	// изменённую ссылку читаем с primary, пока реплики могут её не знать
+	r.change(ChangeEvent{Op: ChangeDeleted, IDs: []string{"AAAAaaaa"}})
+	assert.Nil(t, r.pick(2, "AAAAaaaa"))
+	assert.NotNil(t, r.pick(2, "BBBBbbbb"))
+	r.changed["AAAAaaaa"] = time.Now().Add(-time.Second)
+	assert.NotNil(t, r.pick(2, "AAAAaaaa"))
+	r.pruneWrites()
+	assert.Empty(t, r.changed)
+
+	// после потери уведомлений с primary читаются все ссылки
+	r.change(ChangeEvent{Op: ChangePurge})
+	assert.Nil(t, r.pick(2, "BBBBbbbb"))
+	assert.NotNil(t, r.pick(2, ""), "списки пользователей уведомления не затрагивают")
+	r.purged = time.Time{}
+
+	r.markDown(r.list[0], errors.New("connection refused"))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "r2", r.pick(1, "").host)
+	}
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// openTestPostgres открывает базу из TEST_DATABASE_DSN. Таблицы ссылок очищаются,
+// поэтому нужна отдельная тестовая база. Без переменной тест пропускается.
+func openTestPostgres(t *testing.T) *Postgre {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN не задан")
+	}
+	ctx := context.Background()
+	p, err := OpenPostgres(ctx, dsn, MigrateOptions{}, zap.NewNop())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+
+	_, err = p.db.Exec(ctx, "TRUNCATE url, delete_queue")
+	require.NoError(t, err)
+	return p
+}
+
+func TestPostgresBatch(t *testing.T) {
+	p := openTestPostgres(t)
+	userID, err := p.GetNewUser(context.Background())
+	require.NoError(t, err)
+	ctx := userContext(userID)
+
+	// пачка больше лимита параметров Postgres
+	const n = 100000
+	batch := make(ReqBatchURLs, n)
+	for i := range batch {
+		batch[i] = ReqBatchURL{ID: fmt.Sprintf("b%07d", i), URL: fmt.Sprintf("http://batch.ru/%d", i)}
+	}
+	_, err = p.WriteBatchURL(ctx, &batch)
+	require.NoError(t, err)
+
+	stats, err := p.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, n, stats.URLs)
+
+	check := make(ReqBatchURLs, 0, n+1)
+	for i := 0; i < n; i++ {
+		check = append(check, ReqBatchURL{URL: fmt.Sprintf("http://batch.ru/%d", i)})
+	}
+	check = append(check, ReqBatchURL{URL: "http://new.ru"})
+	_, err = p.CheckBatchURL(ctx, &check)
+	require.NoError(t, err)
+
+	for i := 0; i < n; i++ {
+		require.ErrorIs(t, check[i].Err, entity.ErrURLExist)
+		require.Equal(t, fmt.Sprintf("b%07d", i), check[i].ID)
+	}
+	assert.NoError(t, check[n].Err)
+
+	// чужие ссылки пачка не находит, как и CheckURL
+	otherID, err := p.GetNewUser(context.Background())
+	require.NoError(t, err)
+	other := ReqBatchURLs{{URL: "http://batch.ru/0"}}
+	_, err = p.CheckBatchURL(userContext(otherID), &other)
+	require.NoError(t, err)
+	assert.NoError(t, other[0].Err)
+}
+
+func TestPostgresMigrationLock(t *testing.T) {
+	p := openTestPostgres(t)
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	ctx := context.Background()
+
+	// одновременный старт нескольких экземпляров
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = Migrations(ctx, dsn, MigrateOptions{}, zap.NewNop())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// блокировку держит другой экземпляр
+	conn, err := p.db.Acquire(ctx)
+	require.NoError(t, err)
+	defer conn.Release()
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", pgMigrationLockID)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, Migrations(ctx, dsn, MigrateOptions{LockTimeout: time.Second}, zap.NewNop()), ErrMigrationLock)
+
+	// ожидающий экземпляр продолжает, когда блокировку отпустили
+	done := make(chan error, 1)
+	go func() { done <- Migrations(ctx, dsn, MigrateOptions{LockTimeout: 10 * time.Second}, zap.NewNop()) }()
+	time.Sleep(2 * pgMigrationLockRetry)
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", pgMigrationLockID)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+}
+
+func TestPostgresReplicas(t *testing.T) {
+	openTestPostgres(t)
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	ctx := context.Background()
+
+	// роль реплики играет та же база
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	p, err := OpenPostgres(ctx, dsn+sep+url.Values{"replica": {dsn}}.Encode(), MigrateOptions{}, zap.NewNop())
+	require.NoError(t, err)
+	defer p.Close()
+	require.Len(t, p.replicas.list, 1)
+	rep := p.replicas.list[0]
+	assert.True(t, rep.healthy.Load())
+
+	userID, err := p.GetNewUser(ctx)
+	require.NoError(t, err)
+	require.NoError(t, p.AddURL(userContext(userID), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	assert.True(t, p.replicas.recentWrite(userID))
+	assert.True(t, p.replicas.recentChange("AAAAaaaa"), "новую ссылку читаем с primary")
+	owned, err := p.OwnedIDs(ctx, userID, []string{"AAAAaaaa", "BBBBbbbb"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AAAAaaaa"}, owned)
+
+	data, ok, err := p.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "http://ya.ru", data.URL)
+
+	// при ошибке реплики чтение уходит на primary
+	rep.pool.Close()
+	urls, err := p.GetURLsByUser(ctx, userID+1)
+	require.NoError(t, err)
+	assert.Empty(t, urls)
+	_, ok, err = p.CheckURL(ctx, "http://ya.ru")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, rep.healthy.Load())
+}
+
+func TestPostgresNotifyInvalidatesCache(t *testing.T) {
+	p := openTestPostgres(t)
+	ctx := context.Background()
+
+	// второй экземпляр сервиса с локальным кешем, в том числе промахов
+	other, err := OpenPostgres(ctx, os.Getenv("TEST_DATABASE_DSN"), MigrateOptions{}, zap.NewNop())
+	require.NoError(t, err)
+	cache := NewCachedRepository(other, zap.NewNop(), CacheOptions{Size: 100, NegativeTTL: time.Hour})
+	t.Cleanup(func() { _ = cache.Close() })
+
+	events := make(chan ChangeEvent, 10)
+	other.Listen(ctx, func(ev ChangeEvent) {
+		cache.Apply(ev)
+		events <- ev
+	})
+	// уведомления, отправленные до LISTEN, теряются, поэтому ждём подписки
+	require.Eventually(t, func() bool {
+		var n int
+		err := p.db.QueryRow(ctx, "SELECT count(*) FROM pg_stat_activity WHERE query = 'LISTEN "+changesChannel+"'").Scan(&n)
+		return err == nil && n > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	userID, err := p.GetNewUser(ctx)
+	require.NoError(t, err)
+
+	_, ok, err := cache.CheckID(ctx, "NNNNnnnn")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, p.AddURL(userContext(userID), URLData{ID: "NNNNnnnn", URL: "http://notify.ru"}))
+	select {
+	case ev := <-events:
+		assert.Equal(t, ChangeEvent{Op: ChangeUpdated, IDs: []string{"NNNNnnnn"}}, ev)
+	case <-time.After(5 * time.Second):
+		t.Fatal("уведомление о новой ссылке не пришло")
+	}
+	v, ok, err := cache.CheckID(ctx, "NNNNnnnn")
+	require.NoError(t, err)
+	require.True(t, ok, "промах должен быть сброшен уведомлением")
+	assert.Equal(t, "http://notify.ru", v.URL)
+
+	// повторная вставка ничего не меняет и не уведомляет
+	var exist *URLExistError
+	require.ErrorAs(t, p.AddURL(userContext(userID), URLData{ID: "MMMMmmmm", URL: "http://notify.ru"}), &exist)
+	require.NoError(t, p.RemoveURL(userContext(userID), []URLData{{ID: "NNNNnnnn"}}))
+	select {
+	case ev := <-events:
+		assert.Equal(t, ChangeEvent{Op: ChangeDeleted, IDs: []string{"NNNNnnnn"}}, ev)
+	case <-time.After(5 * time.Second):
+		t.Fatal("уведомление об удалении не пришло")
+	}
+	v, _, err = cache.CheckID(ctx, "NNNNnnnn")
+	require.NoError(t, err)
+	assert.True(t, v.Deleted)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Store хранилище, открытое через Open. Close освобождает соединения и файлы хранилища.
+type Store interface {
+	Repository
+	io.Closer
+}
+
+// Factory открывает хранилище по DSN. Параметры хранилища передаются в query DSN,
+// секреты — в opts.
+type Factory func(ctx context.Context, dsn string, opts Options, l *zap.Logger) (Store, error)
+
+// Options настройки хранилища, которые нельзя передавать в DSN:
+// DSN попадает в логи и тексты ошибок
+type Options struct {
+	// FileKey ключ шифрования файла бекапа
+	FileKey []byte
+	// FileOldKeys прежние ключи файла бекапа, нужны для чтения после ротации ключа
+	FileOldKeys [][]byte
+	// Migrate настройки миграций схемы SQL-хранилищ
+	Migrate MigrateOptions
+}
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register регистрирует фабрику хранилища для схемы DSN.
+// Повторная регистрация схемы — ошибка программиста, поэтому паникуем, как database/sql.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := factories[scheme]; dup {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// Schemes возвращает отсортированный список зарегистрированных схем
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+	for s := range factories {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open открывает хранилище по схеме DSN. DSN без схемы считается строкой подключения
+// к Postgres в формате key=value, как раньше принимал флаг -d.
+func Open(ctx context.Context, dsn string, l *zap.Logger) (Store, error) {
+	return OpenWith(ctx, dsn, Options{}, l)
+}
+
+// OpenWith открывает хранилище как Open, передавая фабрике настройки opts
+func OpenWith(ctx context.Context, dsn string, opts Options, l *zap.Logger) (Store, error) {
+	scheme := "postgres"
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		scheme = u.Scheme
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage scheme %q, registered: %s", scheme, strings.Join(Schemes(), ", "))
+	}
+
+	l.Info("Открываем хранилище", zap.String("scheme", scheme))
+	return factory(ctx, dsn, opts, l)
+}
+
+// dsnPath путь к файлу из DSN вида scheme:///abs/path или scheme://relative/path
+func dsnPath(dsn string, scheme string) (string, url.Values, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Scheme != scheme {
+		return "", nil, fmt.Errorf("unsupported %s dsn %q", scheme, dsn)
+	}
+	path := u.Host + u.Path
+	if path == "" {
+		// scheme:relative/path
+		path = u.Opaque
+	}
+	if path == "" {
+		return "", nil, fmt.Errorf("empty %s path in %q", scheme, dsn)
+	}
+	return path, u.Query(), nil
+}
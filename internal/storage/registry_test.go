@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop()
+
+	t.Run("unknown scheme", func(t *testing.T) {
+		_, err := Open(ctx, "redis://localhost", l)
+		assert.ErrorContains(t, err, `unknown storage scheme "redis"`)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		s, err := Open(ctx, "memory://", l)
+		require.NoError(t, err)
+		assert.IsType(t, &InternalStorage{}, s)
+		assert.NoError(t, s.Close())
+	})
+
+	t.Run("file options", func(t *testing.T) {
+		dsn := "file://" + filepath.Join(t.TempDir(), "db.bin") + "?encoding=binary&sync=none&compact_records=5"
+		s, err := Open(ctx, dsn, l)
+		require.NoError(t, err)
+		is := s.(*InternalStorage)
+		assert.Equal(t, FileOptions{CompactThreshold: 5, Sync: SyncNone, SyncInterval: 0, Encoding: EncodingBinary}, is.Backuper.opts)
+
+		user, err := s.GetNewUser(ctx)
+		require.NoError(t, err)
+		require.NoError(t, s.AddURL(userContext(user), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+		require.NoError(t, s.Close())
+
+		s, err = Open(ctx, dsn, l)
+		require.NoError(t, err)
+		defer s.Close()
+		_, ok, err := s.CheckID(ctx, "AAAAaaaa")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("file bad option", func(t *testing.T) {
+		_, err := Open(ctx, "file://"+filepath.Join(t.TempDir(), "db.json")+"?sync=sometimes", l)
+		assert.Error(t, err)
+	})
+
+	t.Run("file key", func(t *testing.T) {
+		dsn := (&url.URL{Scheme: "file", Path: filepath.Join(t.TempDir(), "my db?.json")}).String()
+		key := bytes.Repeat([]byte{1}, 32)
+
+		_, err := Open(ctx, dsn+"?key="+hex.EncodeToString(key), l)
+		assert.Error(t, err, "ключ в DSN попал бы в логи")
+
+		s, err := OpenWith(ctx, dsn, Options{FileKey: key}, l)
+		require.NoError(t, err)
+		assert.NotNil(t, s.(*InternalStorage).Backuper.keys)
+		require.NoError(t, s.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+		require.NoError(t, s.Close())
+
+		_, err = Open(ctx, dsn, l)
+		assert.ErrorIs(t, err, ErrKeyRequired)
+	})
+}
+
+func TestOwnedIDs(t *testing.T) {
+	for _, scheme := range []string{"memory", "sqlite", "bolt"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := Open(ctx, scheme+"://"+filepath.Join(t.TempDir(), "urls.db"), zap.NewNop())
+			require.NoError(t, err)
+			defer s.Close()
+
+			owner, err := s.GetNewUser(ctx)
+			require.NoError(t, err)
+			other, err := s.GetNewUser(ctx)
+			require.NoError(t, err)
+			require.NoError(t, s.AddURL(userContext(owner), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+			require.NoError(t, s.AddURL(userContext(other), URLData{ID: "BBBBbbbb", URL: "http://ya.ru"}))
+
+			owned, err := s.OwnedIDs(ctx, owner, []string{"AAAAaaaa", "BBBBbbbb", "CCCCcccc"})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"AAAAaaaa"}, owned)
+		})
+	}
+}
+
+func TestIDCollision(t *testing.T) {
+	for _, scheme := range []string{"memory", "sqlite", "bolt"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := Open(ctx, scheme+"://"+filepath.Join(t.TempDir(), "urls.db"), zap.NewNop())
+			require.NoError(t, err)
+			defer s.Close()
+
+			owner, err := s.GetNewUser(ctx)
+			require.NoError(t, err)
+			other, err := s.GetNewUser(ctx)
+			require.NoError(t, err)
+			require.NoError(t, s.AddURL(userContext(owner), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+
+			// ID чужой ссылки тоже занят
+			_, ok, err := s.CheckID(userContext(other), "AAAAaaaa")
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			err = s.AddURL(userContext(other), URLData{ID: "AAAAaaaa", URL: "http://other.ru"})
+			assert.ErrorIs(t, err, entity.ErrIDExist)
+
+			b := ReqBatchURLs{{ID: "BBBBbbbb", URL: "http://b.ru"}, {ID: "AAAAaaaa", URL: "http://other.ru"}}
+			res, err := s.WriteBatchURL(userContext(other), &b)
+			if err == nil {
+				assert.ErrorIs(t, (*res)[1].Err, entity.ErrIDExist)
+			} else {
+				assert.ErrorIs(t, err, entity.ErrIDExist)
+			}
+		})
+	}
+}
@@ -2,20 +2,28 @@ package storage
 
 import (
 	"context"
+
+	"github.com/Taboon/urlshortner/internal/entity"
 )
 
 type Repository interface {
-	// AddURL Возвращает ошибку, если не удалось добавить URL
+	// AddURL Возвращает ошибку, если не удалось добавить URL. Если пользователь
+	// уже сокращал этот URL, возвращает *URLExistError с ID существующей ссылки.
+	// Если ID занят другой ссылкой, возвращает entity.ErrIDExist.
 	AddURL(ctx context.Context, data URLData) error
-	// AddBatchURL Возвращает ошибку, если не удалось добавить массив URL
+	// AddBatchURL Возвращает ошибку, если не удалось добавить массив URL.
+	// Занятый ID хранилище с транзакциями возвращает ошибкой entity.ErrIDExist для
+	// всей пачки, остальные отмечают им строку.
 	WriteBatchURL(ctx context.Context, b *ReqBatchURLs) (*ReqBatchURLs, error)
 	// CheckID Возвращает \URLData и true, если идентификатор найден, иначе возвращает пустую структуру \URLData и false.
+	// Ищет среди ссылок всех пользователей, пользователь из контекста не учитывается.
 	CheckID(ctx context.Context, id string) (URLData, bool, error)
 	// CheckURL Возвращает \URLData и true, если URL найден, иначе возвращает пустую структуру \URLData и false.
 	CheckURL(ctx context.Context, url string) (URLData, bool, error)
 	// CheckBatchURL Проверяет url на наличие в базе. Если присутствует в базе, то свойство Exist = false
 	CheckBatchURL(ctx context.Context, urls *ReqBatchURLs) (*ReqBatchURLs, error)
-	// RemoveURL Возвращает ошибку, если не удалось удалить URLData.
+	// RemoveURL помечает удалёнными URLData пользователя из контекста (UserID).
+	// Чужие идентификаторы не удаляются. Возвращает ошибку, если не удалось удалить URLData.
 	RemoveURL(ctx context.Context, data []URLData) error
 	// Ping проверяет соединение с БД
 	// Возвращает 200 или 500
@@ -24,4 +32,51 @@ type Repository interface {
 	GetNewUser(ctx context.Context) (int, error)
 	// GetURLByUser возвращает структуру содержащую список всех url пользователя
 	GetURLsByUser(ctx context.Context, id int) (UserURLs, error)
+	// OwnedIDs возвращает идентификаторы из ids, которые принадлежат пользователю userID.
+	// Читает с основной базы: только что созданная ссылка тоже принадлежит пользователю.
+	OwnedIDs(ctx context.Context, userID int, ids []string) ([]string, error)
+}
+
+// DeleteJournal хранит задачи на удаление, которые ещё не применены к хранилищу,
+// чтобы после перезапуска их можно было выполнить повторно.
+type DeleteJournal interface {
+	// AppendDeletes сохраняет задачи до их выполнения
+	AppendDeletes(ctx context.Context, tasks []DeleteTask) error
+	// AckDeletes убирает из журнала выполненные задачи
+	AckDeletes(ctx context.Context, tasks []DeleteTask) error
+	// PendingDeletes возвращает задачи, которые ещё не выполнены
+	PendingDeletes(ctx context.Context) ([]DeleteTask, error)
+}
+
+// Exporter постранично отдаёт все данные хранилища для переноса в другое хранилище
+type Exporter interface {
+	// Stats возвращает количество ссылок и последний выданный ID пользователя
+	Stats(ctx context.Context) (Stats, error)
+	// ExportURLs возвращает до limit ссылок с ID больше after в порядке возрастания ID
+	ExportURLs(ctx context.Context, after string, limit int) ([]Record, error)
+}
+
+// Importer принимает данные, выгруженные Exporter. Повторный импорт тех же
+// записей не создаёт дублей, поэтому прерванный перенос можно продолжить.
+type Importer interface {
+	Stats(ctx context.Context) (Stats, error)
+	// ImportUsers создаёт пользователей с ID до lastUserID включительно,
+	// чтобы новые пользователи получали ID после перенесённых
+	ImportUsers(ctx context.Context, lastUserID int) error
+	// ImportURLs записывает ссылки вместе с владельцем и признаком удаления
+	ImportURLs(ctx context.Context, records []Record) error
+}
+
+// URLExistError пользователь уже сокращал этот URL. Уникальность пары пользователь
+// и URL проверяет само хранилище, поэтому параллельные запросы получают один ID.
+type URLExistError struct {
+	ID string
+}
+
+func (e *URLExistError) Error() string {
+	return entity.ErrURLExist.Error() + ": " + e.ID
+}
+
+func (e *URLExistError) Unwrap() error {
+	return entity.ErrURLExist
 }
@@ -0,0 +1,488 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrCacheUnavailable общий кеш отключён автоматом после серии ошибок
+var ErrCacheUnavailable = errors.New("shared cache unavailable")
+
+// RESPOptions настройки клиента кеша, говорящего по протоколу Redis (RESP)
+type RESPOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	// PoolSize максимальное количество соединений
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// BreakerFailures сколько ошибок подряд размыкают автомат. 0 отключает автомат.
+	BreakerFailures int
+	// BreakerCooldown сколько автомат остаётся разомкнутым до пробного запроса
+	BreakerCooldown time.Duration
+}
+
+// ParseRESPOptions разбирает DSN вида redis://[:password@]host:port[/db]?pool_size=10&read_timeout=50ms
+func ParseRESPOptions(dsn string) (RESPOptions, error) {
+	opts := RESPOptions{
+		PoolSize:        10,
+		DialTimeout:     time.Second,
+		ReadTimeout:     100 * time.Millisecond,
+		WriteTimeout:    100 * time.Millisecond,
+		BreakerFailures: 5,
+		BreakerCooldown: 5 * time.Second,
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return opts, err
+	}
+	if u.Scheme != "redis" {
+		return opts, fmt.Errorf("unsupported shared cache dsn %q", u.Redacted())
+	}
+	opts.Addr = u.Host
+	if u.Port() == "" {
+		opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if p, ok := u.User.Password(); ok {
+		opts.Password = p
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil {
+			return opts, fmt.Errorf("db: %w", err)
+		}
+	}
+
+	q := u.Query()
+	if v := q.Get("pool_size"); v != "" {
+		if opts.PoolSize, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("pool_size: %w", err)
+		}
+	}
+	if v := q.Get("breaker_failures"); v != "" {
+		if opts.BreakerFailures, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("breaker_failures: %w", err)
+		}
+	}
+	durations := map[string]*time.Duration{
+		"dial_timeout":     &opts.DialTimeout,
+		"read_timeout":     &opts.ReadTimeout,
+		"write_timeout":    &opts.WriteTimeout,
+		"breaker_cooldown": &opts.BreakerCooldown,
+	}
+	for name, d := range durations {
+		if v := q.Get(name); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil {
+				return opts, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	if opts.PoolSize <= 0 {
+		return opts, fmt.Errorf("pool_size must be positive")
+	}
+	return opts, nil
+}
+
+// RESPClient минимальный клиент Redis для общего кеша: GET, SET, SET NX, DEL.
+// Ошибки сети размыкают автомат, и пока он разомкнут, запросы сразу
+// возвращают ErrCacheUnavailable, не дожидаясь таймаутов.
+type RESPClient struct {
+	opts RESPOptions
+	log  *zap.Logger
+
+	// sem ограничивает количество соединений, idle хранит свободные
+	sem  chan struct{}
+	idle chan *respConn
+
+	breaker breaker
+}
+
+var _ SharedCache = (*RESPClient)(nil)
+
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// respError ответ сервера с ошибкой. Соединение после него остаётся рабочим.
+type respError string
+
+func (e respError) Error() string {
+	return "resp: " + string(e)
+}
+
+func NewRESPClient(opts RESPOptions, l *zap.Logger) *RESPClient {
+	c := &RESPClient{
+		opts: opts,
+		log:  l,
+		sem:  make(chan struct{}, opts.PoolSize),
+		idle: make(chan *respConn, opts.PoolSize),
+	}
+	c.breaker = breaker{
+		threshold: opts.BreakerFailures,
+		cooldown:  opts.BreakerCooldown,
+		log:       l,
+	}
+	return c
+}
+
+func (c *RESPClient) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := c.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	if v == nil {
+		return nil, false, nil
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("resp: unexpected GET reply %T", v)
+	}
+	return b, true, nil
+}
+
+// Set сохраняет значение. ttl 0 — без срока жизни.
+func (c *RESPClient) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := c.do(ctx, args...)
+	return err
+}
+
+// SetMany сохраняет одно значение под несколькими ключами за один обмен с сервером
+func (c *RESPClient) SetMany(ctx context.Context, keys []string, value []byte, ttl time.Duration) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	cmds := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		args := []string{"SET", key, string(value)}
+		if ttl > 0 {
+			args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+		}
+		cmds = append(cmds, args)
+	}
+	_, err := c.pipeline(ctx, cmds)
+	return err
+}
+
+// Add сохраняет значение командой SET NX, только если ключа нет
+func (c *RESPClient) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	v, err := c.do(ctx, append(args, "NX")...)
+	if err != nil {
+		return false, err
+	}
+	return v != nil, nil
+}
+
+// Close закрывает свободные соединения. Занятые закрываются по возвращении в пул.
+func (c *RESPClient) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *RESPClient) do(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.pipeline(ctx, [][]string{args})
+	if replies == nil {
+		return nil, err
+	}
+	return replies[0], err
+}
+
+// pipeline отправляет команды одним пакетом и возвращает ответы по порядку.
+// Ошибка сервера в ответе на одну из команд возвращается вместе с ответами.
+func (c *RESPClient) pipeline(ctx context.Context, cmds [][]string) ([]any, error) {
+	allowed, probe := c.breaker.allow()
+	if !allowed {
+		return nil, ErrCacheUnavailable
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		if probe {
+			// пробный запрос не дошёл до сервера, проверить кеш сможет следующий
+			c.breaker.abort()
+		}
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.sem }()
+
+	conn, err := c.conn(ctx)
+	if err != nil {
+		c.breaker.failure(err)
+		return nil, err
+	}
+
+	replies, err := conn.pipeline(ctx, c.opts, cmds)
+	var rerr respError
+	if err != nil && !errors.As(err, &rerr) {
+		// после сетевой ошибки или таймаута в соединении может остаться недочитанный ответ
+		_ = conn.Close()
+		c.breaker.failure(err)
+		return nil, err
+	}
+	c.breaker.success()
+	c.release(conn)
+	return replies, err
+}
+
+func (c *RESPClient) conn(ctx context.Context) (*respConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	if c.opts.Password != "" {
+		if _, err := conn.roundTrip(ctx, c.opts, []string{"AUTH", c.opts.Password}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := conn.roundTrip(ctx, c.opts, []string{"SELECT", strconv.Itoa(c.opts.DB)}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *RESPClient) release(conn *respConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (conn *respConn) roundTrip(ctx context.Context, opts RESPOptions, args []string) (any, error) {
+	replies, err := conn.pipeline(ctx, opts, [][]string{args})
+	if replies == nil {
+		return nil, err
+	}
+	return replies[0], err
+}
+
+// pipeline пишет команды и читает ответы на все, даже если сервер ответил ошибкой:
+// иначе в соединении остались бы недочитанные ответы
+func (conn *respConn) pipeline(ctx context.Context, opts RESPOptions, cmds [][]string) ([]any, error) {
+	if err := conn.SetWriteDeadline(deadline(ctx, opts.WriteTimeout)); err != nil {
+		return nil, err
+	}
+	for _, args := range cmds {
+		if err := writeCommand(conn.w, args); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(deadline(ctx, opts.ReadTimeout)); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	var serverErr error
+	for i := range cmds {
+		v, err := readReply(conn.r)
+		var rerr respError
+		if err != nil && !errors.As(err, &rerr) {
+			return nil, err
+		}
+		if err != nil && serverErr == nil {
+			serverErr = err
+		}
+		replies[i] = v
+	}
+	return replies, serverErr
+}
+
+// deadline ближайший из срока контекста и таймаута операции
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (d.IsZero() || ctxDeadline.Before(d)) {
+		d = ctxDeadline
+	}
+	return d
+}
+
+func writeCommand(w *bufio.Writer, args []string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply читает ответ: string, []byte, int64, []any, nil или respError
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("resp: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("resp: unknown reply type %q", line[0])
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// breaker автомат: после threshold ошибок подряд размыкается на cooldown,
+// затем пропускает один пробный запрос и по его результату замыкается или снова размыкается
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	log       *zap.Logger
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow разрешает запрос. probe сообщает, что запрос пробный: о его исходе
+// нужно сообщить через success, failure или abort, иначе автомат не замкнётся.
+func (b *breaker) allow() (allowed bool, probe bool) {
+	if b.threshold <= 0 {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true, false
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// abort снимает пробный запрос, который не дошёл до сервера
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openUntil.IsZero() {
+		b.log.Info("Общий кеш снова доступен")
+	}
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+func (b *breaker) failure(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		if b.openUntil.IsZero() || b.probing {
+			b.log.Error("Общий кеш недоступен, отключаем", zap.Error(err), zap.Duration("cooldown", b.cooldown))
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.probing = false
+	}
+}
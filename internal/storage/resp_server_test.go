@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// respServer сервер RESP в памяти процесса вместо настоящего Redis.
+// Понимает PING, AUTH, SELECT, GET, SET с PX/EX/NX и DEL.
+type respServer struct {
+	ln       net.Listener
+	password string
+	// stall заставляет сервер не отвечать, чтобы проверить таймауты клиента
+	stall atomic.Bool
+
+	mu    sync.Mutex
+	data  map[string]respItem
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+type respItem struct {
+	value   string
+	expires time.Time
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{
+		ln:       ln,
+		password: password,
+		data:     make(map[string]respItem),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *respServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *respServer) Close() {
+	_ = s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *respServer) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s *respServer) Value(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.data[key]
+	return it.value, ok
+}
+
+func (s *respServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *respServer) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	authed := s.password == ""
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, ok := v.([]any)
+		if !ok || len(args) == 0 {
+			return
+		}
+		if s.stall.Load() {
+			continue
+		}
+
+		cmd := make([]string, 0, len(args))
+		for _, a := range args {
+			b, _ := a.([]byte)
+			cmd = append(cmd, string(b))
+		}
+		name := strings.ToUpper(cmd[0])
+
+		var reply string
+		switch {
+		case name == "AUTH":
+			if len(cmd) == 2 && cmd[1] == s.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.exec(name, cmd[1:])
+		}
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *respServer) exec(name string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch name {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if len(args) != 1 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+		it, ok := s.data[args[0]]
+		if !ok || (!it.expires.IsZero() && time.Now().After(it.expires)) {
+			delete(s.data, args[0])
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(it.value), it.value)
+	case "SET":
+		if len(args) < 2 {
+			return "-ERR syntax error\r\n"
+		}
+		it := respItem{value: args[1]}
+		nx := false
+		for opts := args[2:]; len(opts) > 0; {
+			switch opt := strings.ToUpper(opts[0]); {
+			case opt == "NX":
+				nx = true
+				opts = opts[1:]
+			case (opt == "PX" || opt == "EX") && len(opts) > 1:
+				n, err := strconv.Atoi(opts[1])
+				if err != nil {
+					return "-ERR value is not an integer\r\n"
+				}
+				unit := time.Millisecond
+				if opt == "EX" {
+					unit = time.Second
+				}
+				it.expires = time.Now().Add(time.Duration(n) * unit)
+				opts = opts[2:]
+			default:
+				return "-ERR syntax error\r\n"
+			}
+		}
+		if old, ok := s.data[args[0]]; nx && ok && (old.expires.IsZero() || time.Now().Before(old.expires)) {
+			return "$-1\r\n"
+		}
+		s.data[args[0]] = it
+		return "+OK\r\n"
+	default:
+		return "-ERR unknown command '" + name + "'\r\n"
+	}
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseRESPOptions(t *testing.T) {
+	opts, err := ParseRESPOptions("redis://:secret@cache:6380/2?pool_size=3&read_timeout=20ms&breaker_failures=0")
+	require.NoError(t, err)
+	assert.Equal(t, "cache:6380", opts.Addr)
+	assert.Equal(t, "secret", opts.Password)
+	assert.Equal(t, 2, opts.DB)
+	assert.Equal(t, 3, opts.PoolSize)
+	assert.Equal(t, 20*time.Millisecond, opts.ReadTimeout)
+	assert.Equal(t, 0, opts.BreakerFailures)
+
+	opts, err = ParseRESPOptions("redis://cache")
+	require.NoError(t, err)
+	assert.Equal(t, "cache:6379", opts.Addr)
+
+	_, err = ParseRESPOptions("memcached://cache")
+	assert.Error(t, err)
+	_, err = ParseRESPOptions("redis://cache?pool_size=0")
+	assert.Error(t, err)
+}
+
+func newTestRESPClient(addr string, password string) *RESPClient {
+	return NewRESPClient(RESPOptions{
+		Addr:            addr,
+		Password:        password,
+		PoolSize:        2,
+		DialTimeout:     time.Second,
+		ReadTimeout:     50 * time.Millisecond,
+		WriteTimeout:    50 * time.Millisecond,
+		BreakerFailures: 2,
+		BreakerCooldown: 100 * time.Millisecond,
+	}, zap.NewNop())
+}
+
+func TestRESPClient(t *testing.T) {
+	ctx := context.Background()
+	srv := newRESPServer(t, "secret")
+	c := newTestRESPClient(srv.Addr(), "secret")
+	defer c.Close()
+
+	_, ok, err := c.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, c.Set(ctx, "k", []byte("v\r\nv"), 0))
+	v, ok, err := c.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "v\r\nv", string(v))
+
+	require.NoError(t, c.Set(ctx, "ttl", []byte("v"), 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	_, ok, err = c.Get(ctx, "ttl")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// SET NX не перезаписывает существующий ключ
+	added, err := c.Add(ctx, "k", []byte("other"), time.Minute)
+	require.NoError(t, err)
+	assert.False(t, added)
+	added, err = c.Add(ctx, "new", []byte("v"), time.Minute)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	require.NoError(t, c.SetMany(ctx, []string{"m1", "m2"}, []byte("m"), time.Minute))
+	for _, k := range []string{"m1", "m2"} {
+		v, ok, err := c.Get(ctx, k)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, "m", string(v))
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		c := newTestRESPClient(srv.Addr(), "wrong")
+		defer c.Close()
+		_, _, err := c.Get(ctx, "k")
+		var rerr respError
+		assert.ErrorAs(t, err, &rerr)
+	})
+}
+
+func TestRESPClientBreaker(t *testing.T) {
+	ctx := context.Background()
+	srv := newRESPServer(t, "")
+	c := newTestRESPClient(srv.Addr(), "")
+	defer c.Close()
+
+	require.NoError(t, c.Set(ctx, "k", []byte("v"), 0))
+
+	// сервер завис: запросы падают по таймауту, после двух ошибок автомат размыкается
+	srv.stall.Store(true)
+	for i := 0; i < 2; i++ {
+		_, _, err := c.Get(ctx, "k")
+		var nerr net.Error
+		require.ErrorAs(t, err, &nerr)
+		assert.True(t, nerr.Timeout())
+	}
+	start := time.Now()
+	_, _, err := c.Get(ctx, "k")
+	assert.ErrorIs(t, err, ErrCacheUnavailable)
+	assert.Less(t, time.Since(start), 10*time.Millisecond, "разомкнутый автомат не ждёт таймаута")
+
+	// после паузы пробный запрос проходит и замыкает автомат
+	srv.stall.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	v, ok, err := c.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "v", string(v))
+
+	t.Run("server down", func(t *testing.T) {
+		srv.Close()
+		for i := 0; i < 2; i++ {
+			_, _, err := c.Get(ctx, "k")
+			require.Error(t, err)
+			assert.False(t, errors.Is(err, ErrCacheUnavailable))
+		}
+		_, _, err := c.Get(ctx, "k")
+		assert.ErrorIs(t, err, ErrCacheUnavailable)
+	})
+}
+
+func TestRESPClientBreakerProbeCancelled(t *testing.T) {
+	ctx := context.Background()
+	srv := newRESPServer(t, "")
+	c := newTestRESPClient(srv.Addr(), "")
+	defer c.Close()
+
+	c.breaker.failure(errors.New("сбой"))
+	c.breaker.failure(errors.New("сбой"))
+	time.Sleep(150 * time.Millisecond)
+
+	// пробный запрос отменён, пока ждал свободного соединения
+	for i := 0; i < cap(c.sem); i++ {
+		c.sem <- struct{}{}
+	}
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, _, err := c.Get(cancelled, "k")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	for i := 0; i < cap(c.sem); i++ {
+		<-c.sem
+	}
+
+	// следующий запрос снова может проверить кеш и замкнуть автомат
+	_, _, err = c.Get(ctx, "k")
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "k")
+	require.NoError(t, err)
+}
+
+func TestCachedRepositoryShared(t *testing.T) {
+	ctx := context.Background()
+	srv := newRESPServer(t, "")
+
+	// два экземпляра сервиса над одним хранилищем и одним общим кешем
+	inner := &countingStore{InternalStorage: NewMemoryStorage(zap.NewNop())}
+	opts := CacheOptions{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute}
+	optsA, optsB := opts, opts
+	optsA.Shared = newTestRESPClient(srv.Addr(), "")
+	optsB.Shared = newTestRESPClient(srv.Addr(), "")
+	a := NewCachedRepository(inner, zap.NewNop(), optsA)
+	b := NewCachedRepository(inner, zap.NewNop(), optsB)
+
+	// ссылка создана до запуска экземпляров: отметки об изменении в общем кеше нет
+	require.NoError(t, inner.AddURL(userContext(1), URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}))
+	_, ok, err := a.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{sharedKeyPrefix + "AAAAaaaa"}, srv.Keys())
+
+	// второй экземпляр берёт ссылку из общего кеша, не обращаясь к хранилищу
+	data, ok, err := b.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, URLData{ID: "AAAAaaaa", URL: "http://ya.ru"}, data)
+	assert.Equal(t, int64(1), inner.lookups.Load())
+	assert.Equal(t, uint64(1), b.CacheStats().SharedHits)
+
+	// удаление заменяет ссылку в общем кеше отметкой, третий экземпляр читает хранилище
+	require.NoError(t, b.RemoveURL(userContext(1), []URLData{{ID: "AAAAaaaa"}}))
+	c := NewCachedRepository(inner, zap.NewNop(), optsA)
+	data, ok, err = c.CheckID(ctx, "AAAAaaaa")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, data.Deleted)
+	assert.Equal(t, int64(2), inner.lookups.Load())
+
+	t.Run("stale read", func(t *testing.T) {
+		// экземпляр прочитал ссылку до её удаления другим экземпляром и записывает
+		// ответ в общий кеш уже после удаления
+		slow := &blockingStore{Store: inner, read: make(chan struct{}), release: make(chan struct{})}
+		optsC := opts
+		optsC.Shared = newTestRESPClient(srv.Addr(), "")
+		c := NewCachedRepository(slow, zap.NewNop(), optsC)
+
+		require.NoError(t, a.AddURL(userContext(1), URLData{ID: "SSSSssss", URL: "http://stale.ru"}))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _, _ = c.CheckID(ctx, "SSSSssss")
+		}()
+		<-slow.read
+		require.NoError(t, b.RemoveURL(userContext(1), []URLData{{ID: "SSSSssss"}}))
+		close(slow.release)
+		<-done
+
+		raw, ok := srv.Value(sharedKeyPrefix + "SSSSssss")
+		require.True(t, ok)
+		var v sharedEntry
+		require.NoError(t, json.Unmarshal([]byte(raw), &v))
+		assert.True(t, v.Tombstone, "устаревший ответ не должен перезаписать отметку удаления")
+
+		fresh := NewCachedRepository(inner, zap.NewNop(), optsA)
+		data, ok, err := fresh.CheckID(ctx, "SSSSssss")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.True(t, data.Deleted)
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		srv.Close()
+		c := NewCachedRepository(inner, zap.NewNop(), optsA)
+		for i := 0; i < 3; i++ {
+			data, ok, err := c.CheckID(ctx, "AAAAaaaa")
+			require.NoError(t, err, "без общего кеша ссылка читается из хранилища")
+			assert.True(t, ok)
+			assert.True(t, data.Deleted)
+			c.Purge()
+		}
+		assert.Equal(t, uint64(6), c.CacheStats().SharedErrors)
+	})
+}
+
+// blockingStore отдаёт ответ хранилища только после release
+type blockingStore struct {
+	Store
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) CheckID(ctx context.Context, id string) (URLData, bool, error) {
+	data, ok, err := s.Store.CheckID(ctx, id)
+	close(s.read)
+	<-s.release
+	return data, ok, err
+}
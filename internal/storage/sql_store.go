@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Taboon/urlshortner/internal/entity"
+	"go.uber.org/zap"
+)
+
+// sqlBatchSize ограничивает количество параметров в одном запросе
+const sqlBatchSize = 500
+
+// sqlDialect различия в синтаксисе SQL-баз, работающих через database/sql
+type sqlDialect struct {
+	// insertIgnore вставка без ошибки на дубликат ключа
+	insertIgnore string
+	// newUser запрос создания пользователя с автоинкрементным ID
+	newUser string
+	// upsertURL вставка ссылки с владельцем, признаками удаления и дубля, при повторе обновляет признак удаления
+	upsertURL string
+	// urlHash выражение хеша параметра для поиска по индексу url_hash.
+	// Пустое, если база индексирует url целиком.
+	urlHash string
+}
+
+// sqlStore общая реализация Repository для баз с параметрами вида ?
+type sqlStore struct {
+	db      *sql.DB
+	Log     *zap.Logger
+	dialect sqlDialect
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	c, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	if err := s.db.PingContext(c); err != nil {
+		s.Log.Error("Ошибка соединения с БД")
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) AddURL(ctx context.Context, urlData URLData) error {
+	s.Log.Debug("Добавляем URL в базу данных", zap.String("url", urlData.URL))
+	id := ctx.Value(UserID)
+
+	c, cancel := context.WithTimeout(ctx, time.Second*1)
+	defer cancel()
+
+	_, err := s.db.ExecContext(c, `INSERT INTO url (id, url, is_deleted, user_id) VALUES (?, ?, FALSE, ?)`, urlData.ID, urlData.URL, id)
+	if err == nil {
+		return nil
+	}
+	// уникальный индекс (user_id, url) пропускает только одну вставку. Проигравший
+	// запрос выполняется после фиксации победителя и находит его ссылку.
+	var existID string
+	cond, args := s.urlMatch(urlData.URL)
+	if selErr := s.db.QueryRowContext(ctx, `SELECT id FROM url WHERE user_id = ? AND `+cond, append([]any{id}, args...)...).Scan(&existID); selErr == nil {
+		return &URLExistError{ID: existID}
+	}
+	// иначе мог быть занят сгенерированный ID
+	if s.db.QueryRowContext(ctx, `SELECT id FROM url WHERE id = ?`, urlData.ID).Scan(&existID) == nil {
+		return fmt.Errorf("%w: %s", entity.ErrIDExist, urlData.ID)
+	}
+	return err
+}
+
+func (s *sqlStore) WriteBatchURL(ctx context.Context, b *ReqBatchURLs) (*ReqBatchURLs, error) {
+	id := ctx.Value(UserID)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO url (id, url, is_deleted, user_id) VALUES (?, ?, FALSE, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for i, v := range *b {
+		// если данные не валидны, пропускаем текущую итерацию
+		if v.Err != nil {
+			continue
+		}
+		if _, err := stmt.ExecContext(ctx, v.ID, v.URL, id); err != nil {
+			// URL успел сохранить параллельный запрос, отдаём его ID
+			var existID string
+			cond, args := s.urlMatch(v.URL)
+			if tx.QueryRowContext(ctx, `SELECT id FROM url WHERE user_id = ? AND `+cond, append([]any{id}, args...)...).Scan(&existID) != nil {
+				// занятый ID откатывает пачку целиком
+				if tx.QueryRowContext(ctx, `SELECT id FROM url WHERE id = ?`, v.ID).Scan(&existID) == nil {
+					return nil, fmt.Errorf("%w: %s", entity.ErrIDExist, v.ID)
+				}
+				return nil, err
+			}
+			(*b)[i].Err = entity.ErrURLExist
+			(*b)[i].ID = existID
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// CheckID ищет ID среди ссылок всех пользователей: ID уникален во всём хранилище
+func (s *sqlStore) CheckID(ctx context.Context, id string) (URLData, bool, error) {
+	return s.check(ctx, 0, "id = ?", id)
+}
+
+func (s *sqlStore) CheckURL(ctx context.Context, url string) (URLData, bool, error) {
+	userID, _ := ctx.Value(UserID).(int)
+	cond, args := s.urlMatch(url)
+	return s.check(ctx, userID, cond, args...)
+}
+
+// urlMatch условие поиска URL: по индексу хеша, если он есть, затем сравнение самих строк.
+// Дубли, оставшиеся от гонок до уникального индекса, открываются только по ID.
+func (s *sqlStore) urlMatch(url string) (string, []any) {
+	if s.dialect.urlHash == "" {
+		return "NOT duplicate AND url = ?", []any{url}
+	}
+	return "NOT duplicate AND url_hash = " + s.dialect.urlHash + " AND url = ?", []any{url, url}
+}
+
+// check ищет ссылку по условию cond, при ненулевом userID только среди ссылок пользователя
+func (s *sqlStore) check(ctx context.Context, userID int, cond string, args ...any) (URLData, bool, error) {
+	var data URLData
+
+	query := "SELECT id, url, is_deleted FROM url WHERE " + cond
+	if userID != 0 {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	row := s.db.QueryRowContext(ctx, query, args...)
+
+	err := row.Scan(&data.ID, &data.URL, &data.Deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return URLData{}, false, nil
+	}
+	if err != nil {
+		s.Log.Error("Ошибка запроса", zap.Error(err))
+		return URLData{}, false, err
+	}
+	return data, true, nil
+}
+
+func (s *sqlStore) CheckBatchURL(ctx context.Context, urls *ReqBatchURLs) (*ReqBatchURLs, error) {
+	userID, _ := ctx.Value(UserID).(int)
+
+	index := make(map[string][]int, len(*urls))
+	values := make([]interface{}, 0, len(*urls))
+	for i, v := range *urls {
+		if v.Err != nil {
+			continue
+		}
+		if _, ok := index[v.URL]; !ok {
+			values = append(values, v.URL)
+		}
+		index[v.URL] = append(index[v.URL], i)
+	}
+
+	for len(values) > 0 {
+		chunk := values[:min(len(values), sqlBatchSize)]
+		values = values[len(chunk):]
+
+		// строки с совпавшим хешем, но другим URL не найдутся в index
+		query := "SELECT url, id, is_deleted FROM url WHERE user_id = ? AND NOT duplicate AND url IN (" + placeholders(len(chunk)) + ")"
+		if s.dialect.urlHash != "" {
+			query = "SELECT url, id, is_deleted FROM url WHERE user_id = ? AND NOT duplicate AND url_hash IN (" +
+				strings.TrimSuffix(strings.Repeat(s.dialect.urlHash+",", len(chunk)), ",") + ")"
+		}
+		rows, err := s.db.QueryContext(ctx, query, append([]interface{}{userID}, chunk...)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var data URLData
+			if err := rows.Scan(&data.URL, &data.ID, &data.Deleted); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			for _, i := range index[data.URL] {
+				(*urls)[i].Err = entity.ErrURLExist
+				(*urls)[i].ID = data.ID
+				(*urls)[i].Deleted = data.Deleted
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+func (s *sqlStore) RemoveURL(ctx context.Context, data []URLData) error {
+	userID, ok := ctx.Value(UserID).(int)
+	if !ok || userID == 0 {
+		return entity.ErrUnknownUser
+	}
+
+	for len(data) > 0 {
+		chunk := data[:min(len(data), sqlBatchSize)]
+		data = data[len(chunk):]
+
+		args := make([]interface{}, 0, len(chunk)+1)
+		args = append(args, userID)
+		for _, v := range chunk {
+			args = append(args, v.ID)
+		}
+		// удаляем только ссылки, принадлежащие пользователю из контекста
+		_, err := s.db.ExecContext(ctx, "UPDATE url SET is_deleted = TRUE WHERE user_id = ? AND id IN ("+placeholders(len(chunk))+")", args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) GetNewUser(ctx context.Context) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.dialect.newUser)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (s *sqlStore) GetURLsByUser(ctx context.Context, id int) (UserURLs, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT url, id, is_deleted FROM url WHERE user_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := UserURLs{}
+	for rows.Next() {
+		var data URLData
+		if err := rows.Scan(&data.URL, &data.ID, &data.Deleted); err != nil {
+			return nil, err
+		}
+		urls = append(urls, data)
+	}
+	return urls, rows.Err()
+}
+
+func (s *sqlStore) OwnedIDs(ctx context.Context, userID int, ids []string) ([]string, error) {
+	owned := make([]string, 0, len(ids))
+	for len(ids) > 0 {
+		chunk := ids[:min(len(ids), sqlBatchSize)]
+		ids = ids[len(chunk):]
+
+		args := make([]any, 0, len(chunk)+1)
+		args = append(args, userID)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		rows, err := s.db.QueryContext(ctx, "SELECT id FROM url WHERE user_id = ? AND id IN ("+placeholders(len(chunk))+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			owned = append(owned, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return owned, nil
+}
+
+func (s *sqlStore) AppendDeletes(ctx context.Context, tasks []DeleteTask) error {
+	return s.execDeletes(ctx, s.dialect.insertIgnore+` INTO delete_queue (id, user_id) VALUES (?, ?)`, tasks)
+}
+
+func (s *sqlStore) AckDeletes(ctx context.Context, tasks []DeleteTask) error {
+	return s.execDeletes(ctx, `DELETE FROM delete_queue WHERE id = ? AND user_id = ?`, tasks)
+}
+
+func (s *sqlStore) execDeletes(ctx context.Context, query string, tasks []DeleteTask) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, t := range tasks {
+		if _, err := stmt.ExecContext(ctx, t.ID, t.UserID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) PendingDeletes(ctx context.Context) ([]DeleteTask, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, user_id FROM delete_queue")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []DeleteTask
+	for rows.Next() {
+		var t DeleteTask
+		if err := rows.Scan(&t.ID, &t.UserID); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// placeholders возвращает список параметров запроса вида ?,?,?
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func (s *sqlStore) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(CASE WHEN is_deleted THEN 1 ELSE 0 END), 0) FROM url").
+		Scan(&stats.URLs, &stats.Deleted)
+	if err != nil {
+		return stats, err
+	}
+	err = s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM users").Scan(&stats.LastUserID)
+	return stats, err
+}
+
+func (s *sqlStore) ExportURLs(ctx context.Context, after string, limit int) ([]Record, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, url, COALESCE(user_id, 0), is_deleted, duplicate FROM url WHERE id > ? ORDER BY id LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.URL, &r.UserID, &r.Deleted, &r.Duplicate); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) ImportUsers(ctx context.Context, lastUserID int) error {
+	var current int
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM users").Scan(&current); err != nil {
+		return err
+	}
+
+	// явно вставленные ID сдвигают автоинкремент, новые пользователи получат ID после lastUserID
+	for current < lastUserID {
+		n := min(lastUserID-current, sqlBatchSize)
+		args := make([]interface{}, 0, n)
+		for i := 1; i <= n; i++ {
+			args = append(args, current+i)
+		}
+		query := s.dialect.insertIgnore + " INTO users (id) VALUES " + strings.TrimSuffix(strings.Repeat("(?),", n), ",")
+		if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		current += n
+	}
+	return nil
+}
+
+func (s *sqlStore) ImportURLs(ctx context.Context, records []Record) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, s.dialect.upsertURL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err := stmt.ExecContext(ctx, r.ID, r.URL, r.Deleted, r.UserID, r.Duplicate); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
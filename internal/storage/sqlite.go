@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3" // sqlite driver
+	"github.com/pressly/goose/v3"
+	"go.uber.org/zap"
+)
+
+type SQLite struct {
+	*sqlStore
+}
+
+var _ Store = (*SQLite)(nil)
+var _ DeleteJournal = (*SQLite)(nil)
+var _ Exporter = (*SQLite)(nil)
+var _ Importer = (*SQLite)(nil)
+
+func init() {
+	Register("sqlite", func(ctx context.Context, dsn string, opts Options, l *zap.Logger) (Store, error) {
+		return SetSQLite(ctx, dsn, opts.Migrate, l)
+	})
+}
+
+func NewSQLiteBase(db *sql.DB, log *zap.Logger) *SQLite {
+	return &SQLite{
+		sqlStore: &sqlStore{
+			db:  db,
+			Log: log,
+			dialect: sqlDialect{
+				insertIgnore: "INSERT OR IGNORE",
+				newUser:      "INSERT INTO users DEFAULT VALUES",
+				upsertURL: `INSERT INTO url (id, url, is_deleted, user_id, duplicate) VALUES (?, ?, ?, NULLIF(?, 0), ?)
+					ON CONFLICT (id) DO UPDATE SET is_deleted = excluded.is_deleted`,
+			},
+		},
+	}
+}
+
+// SetSQLite открывает базу по DSN вида sqlite:///var/lib/shortener.db и применяет миграции
+func SetSQLite(ctx context.Context, dsn string, migrate MigrateOptions, l *zap.Logger) (*SQLite, error) {
+	path, _, err := dsnPath(dsn, "sqlite")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", sqliteConn(path))
+	if err != nil {
+		return nil, err
+	}
+
+	stor := NewSQLiteBase(db, l)
+	if err := stor.Ping(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	m, err := newMigrator(db, goose.DialectSQLite3, "sqlite", migrate, l)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := autoMigrate(ctx, m); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return stor, nil
+}
+
+// sqliteConn строка подключения к файлу базы
+func sqliteConn(path string) string {
+	// WAL позволяет читать параллельно с записью, busy_timeout ждёт освобождения блокировки записи
+	return fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on&_txlock=immediate", path)
+}
@@ -5,4 +5,7 @@ CREATE TABLE url
     id  VARCHAR(8) PRIMARY KEY,
     url VARCHAR(2048)
 );
--- +goose StatementEnd
\ No newline at end of file
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TABLE url;
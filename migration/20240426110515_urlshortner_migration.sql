@@ -10,7 +10,7 @@ ALTER TABLE url
     ADD CONSTRAINT url_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id);
 
 -- +goose Down
-DROP TABLE users;
 ALTER TABLE url
     DROP COLUMN user_id,
     DROP COLUMN is_deleted;
+DROP TABLE users;
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE delete_queue
+(
+    id      VARCHAR(8) NOT NULL,
+    user_id INTEGER    NOT NULL,
+    PRIMARY KEY (id, user_id)
+);
+
+-- +goose Down
+DROP TABLE delete_queue;
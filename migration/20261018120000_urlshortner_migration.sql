@@ -0,0 +1,21 @@
+-- +goose Up
+-- дубли появлялись при гонке двух запросов. Их ID уже выданы пользователям, поэтому
+-- строки остаются и открываются по ID, но помечаются duplicate и не участвуют
+-- в уникальности. Основной остаётся неудалённая ссылка с меньшим ID.
+ALTER TABLE url
+    ADD COLUMN duplicate BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE url SET duplicate = TRUE
+WHERE id IN (SELECT id
+             FROM (SELECT id, row_number() OVER (
+                 PARTITION BY user_id, url ORDER BY COALESCE(is_deleted, FALSE), id) AS n
+                   FROM url) d
+             WHERE n > 1);
+
+CREATE UNIQUE INDEX url_user_id_url_key ON url (user_id, url) WHERE NOT duplicate;
+
+-- +goose Down
+DROP INDEX url_user_id_url_key;
+
+ALTER TABLE url
+    DROP COLUMN duplicate;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- длинные URL не помещаются в btree индекс, поэтому ищем и проверяем уникальность по SHA-256
+ALTER TABLE url
+    ALTER COLUMN url TYPE TEXT,
+    ADD COLUMN url_hash BYTEA GENERATED ALWAYS AS (sha256(convert_to(url, 'UTF8'))) STORED;
+
+DROP INDEX url_user_id_url_key;
+CREATE UNIQUE INDEX url_user_id_url_hash_key ON url (user_id, url_hash) WHERE NOT duplicate;
+
+CREATE INDEX url_url_hash_idx ON url (url_hash);
+
+-- +goose Down
+DROP INDEX url_url_hash_idx;
+
+DROP INDEX url_user_id_url_hash_key;
+CREATE UNIQUE INDEX url_user_id_url_key ON url (user_id, url) WHERE NOT duplicate;
+
+ALTER TABLE url
+    DROP COLUMN url_hash,
+    ALTER COLUMN url TYPE VARCHAR(2048);
@@ -0,0 +1,9 @@
+// Package migration встраивает SQL-миграции в бинарник, чтобы они не зависели
+// от рабочего каталога. Миграции Postgres лежат в корне, SQLite и MySQL — в
+// подкаталогах sqlite и mysql.
+package migration
+
+import "embed"
+
+//go:embed *.sql sqlite/*.sql mysql/*.sql
+var FS embed.FS
@@ -0,0 +1,29 @@
+-- +goose Up
+CREATE TABLE users
+(
+    id INTEGER AUTO_INCREMENT PRIMARY KEY
+);
+
+CREATE TABLE url
+(
+    id         VARCHAR(8) CHARACTER SET ascii COLLATE ascii_bin PRIMARY KEY,
+    url        VARCHAR(2048) NOT NULL,
+    is_deleted BOOLEAN       NOT NULL DEFAULT FALSE,
+    user_id    INTEGER,
+    CONSTRAINT url_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX url_user_id_url_idx ON url (user_id, url(255));
+CREATE INDEX url_url_idx ON url (url(255));
+
+CREATE TABLE delete_queue
+(
+    id      VARCHAR(8) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+    user_id INTEGER    NOT NULL,
+    PRIMARY KEY (id, user_id)
+);
+
+-- +goose Down
+DROP TABLE delete_queue;
+DROP TABLE url;
+DROP TABLE users;
@@ -0,0 +1,27 @@
+-- +goose Up
+-- дубли появлялись при гонке двух запросов. Их ID уже выданы пользователям, поэтому
+-- строки остаются и открываются по ID, но помечаются duplicate. Частичных индексов
+-- в MySQL нет: у дублей url_hash пустой, а NULL уникальный индекс не сравнивает.
+-- Основной остаётся неудалённая ссылка с меньшим ID.
+ALTER TABLE url
+    ADD COLUMN duplicate BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE url u
+    JOIN (SELECT id
+          FROM (SELECT id, ROW_NUMBER() OVER (
+              PARTITION BY user_id, url ORDER BY is_deleted, id) AS n
+                FROM url) r
+          WHERE n > 1) d ON u.id = d.id
+SET u.duplicate = TRUE;
+
+-- индекс по url ограничен префиксом, поэтому уникальность проверяем по хешу
+ALTER TABLE url
+    ADD COLUMN url_hash BINARY(32) AS (IF(duplicate, NULL, UNHEX(SHA2(url, 256)))) STORED;
+
+CREATE UNIQUE INDEX url_user_id_url_hash_key ON url (user_id, url_hash);
+
+-- +goose Down
+DROP INDEX url_user_id_url_hash_key ON url;
+ALTER TABLE url
+    DROP COLUMN url_hash,
+    DROP COLUMN duplicate;
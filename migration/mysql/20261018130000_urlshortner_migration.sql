@@ -0,0 +1,28 @@
+-- +goose Up
+-- url_hash вычисляется из url и duplicate, поэтому пересоздаём его вместе со сменой типа
+DROP INDEX url_user_id_url_hash_key ON url;
+DROP INDEX url_user_id_url_idx ON url;
+DROP INDEX url_url_idx ON url;
+ALTER TABLE url
+    DROP COLUMN url_hash;
+
+ALTER TABLE url
+    MODIFY url MEDIUMTEXT NOT NULL,
+    ADD COLUMN url_hash BINARY(32) AS (IF(duplicate, NULL, UNHEX(SHA2(url, 256)))) STORED;
+
+CREATE UNIQUE INDEX url_user_id_url_hash_key ON url (user_id, url_hash);
+CREATE INDEX url_url_hash_idx ON url (url_hash);
+
+-- +goose Down
+DROP INDEX url_url_hash_idx ON url;
+DROP INDEX url_user_id_url_hash_key ON url;
+ALTER TABLE url
+    DROP COLUMN url_hash;
+
+ALTER TABLE url
+    MODIFY url VARCHAR(2048) NOT NULL,
+    ADD COLUMN url_hash BINARY(32) AS (IF(duplicate, NULL, UNHEX(SHA2(url, 256)))) STORED;
+
+CREATE UNIQUE INDEX url_user_id_url_hash_key ON url (user_id, url_hash);
+CREATE INDEX url_user_id_url_idx ON url (user_id, url(255));
+CREATE INDEX url_url_idx ON url (url(255));
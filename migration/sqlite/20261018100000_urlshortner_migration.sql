@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE users
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT
+);
+
+CREATE TABLE url
+(
+    id         VARCHAR(8) PRIMARY KEY,
+    url        TEXT    NOT NULL,
+    is_deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    user_id    INTEGER REFERENCES users (id)
+);
+
+CREATE INDEX url_user_id_url_idx ON url (user_id, url);
+CREATE INDEX url_url_idx ON url (url);
+
+CREATE TABLE delete_queue
+(
+    id      VARCHAR(8) NOT NULL,
+    user_id INTEGER    NOT NULL,
+    PRIMARY KEY (id, user_id)
+);
+
+-- +goose Down
+DROP TABLE delete_queue;
+DROP TABLE url;
+DROP TABLE users;